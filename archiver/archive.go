@@ -5,27 +5,97 @@
 package archiver
 
 import (
-	"archive/zip"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"sort"
+	"time"
 
 	"github.com/joeshaw/multierror"
 	"github.com/pkg/errors"
 )
 
+// reproducibleModTime is the modification time of all the files in reproducible archives.
+var reproducibleModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Permissions of files and directories in reproducible archives.
+const (
+	reproducibleFileMode os.FileMode = 0644
+	reproducibleDirMode  os.FileMode = 0755 | os.ModeDir
+)
+
+// Format is the format of an archive.
+type Format string
+
+const (
+	FormatZip   Format = "zip"
+	FormatTarGz Format = "tar.gz"
+)
+
 // PackageProperties defines properties describing the package. The structure is used for archiving.
 type PackageProperties struct {
 	Name    string
 	Version string
 	Path    string
+
+	// Reproducible archives only depend on the names and contents of the files of the package, so
+	// the same content produces the same archive. Modification times and permissions of the files
+	// are not kept, entries are sorted by name, and they are compressed with a fixed level.
+	Reproducible bool
 }
 
-// ArchivePackage method builds and streams an archive with package content.
-func ArchivePackage(w io.Writer, properties PackageProperties) (err error) {
-	zipWriter := zip.NewWriter(w)
+// File is a file or directory of a package to be archived.
+type File struct {
+	// Name of the file relative to the root of the package, with slashes as separator.
+	Name string
+	Info os.FileInfo
+
+	// Open opens the file to read its content, it is not used for directories.
+	Open func() (io.ReadCloser, error)
+}
+
+// archiveWriter writes files to an archive in some format.
+type archiveWriter interface {
+	// create adds a file to the archive, its content must be written to the returned writer.
+	create(name string, info os.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+// ArchivePackage method builds and streams a zip archive with package content.
+func ArchivePackage(w io.Writer, properties PackageProperties) error {
+	return archivePackagePath(w, FormatZip, properties)
+}
+
+// ArchivePackageTarGz method builds and streams a tar.gz archive with package content.
+func ArchivePackageTarGz(w io.Writer, properties PackageProperties) error {
+	return archivePackagePath(w, FormatTarGz, properties)
+}
+
+func archivePackagePath(w io.Writer, format Format, properties PackageProperties) error {
+	files, err := packageFiles(properties.Path)
+	if err != nil {
+		return errors.Wrapf(err, "processing package path '%s' failed", properties.Path)
+	}
+	return ArchiveFiles(w, format, properties, files)
+}
+
+// ArchiveFiles builds and streams an archive with the given files of a package. The path in the
+// properties is ignored, files are read with their Open functions.
+func ArchiveFiles(w io.Writer, format Format, properties PackageProperties, files []File) (err error) {
+	var archive archiveWriter
+	switch format {
+	case FormatZip:
+		archive = newZipWriter(w, properties.Reproducible)
+	case FormatTarGz:
+		archive, err = newTarGzWriter(w, properties.Reproducible)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown archive format %q", format)
+	}
 	defer func() {
 		var multiErr multierror.Errors
 
@@ -33,9 +103,9 @@ func ArchivePackage(w io.Writer, properties PackageProperties) (err error) {
 			multiErr = append(multiErr, err)
 		}
 
-		err = zipWriter.Close()
+		err = archive.Close()
 		if err != nil {
-			multiErr = append(multiErr, errors.Wrapf(err, "closing zip writer failed"))
+			multiErr = append(multiErr, errors.Wrapf(err, "closing %s writer failed", format))
 		}
 
 		if multiErr != nil {
@@ -43,69 +113,63 @@ func ArchivePackage(w io.Writer, properties PackageProperties) (err error) {
 		}
 	}()
 
-	rootDir := fmt.Sprintf("%s-%s", properties.Name, properties.Version)
-	err = filepath.Walk(properties.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	if properties.Reproducible {
+		files = append([]File(nil), files...)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
 
-		relativePath, err := filepath.Rel(properties.Path, path)
+	rootDir := fmt.Sprintf("%s-%s", properties.Name, properties.Version)
+	for _, f := range files {
+		name := path.Join(rootDir, f.Name)
+		w, err := archive.create(name, f.Info)
 		if err != nil {
-			return errors.Wrapf(err, "finding relative path failed (packagePath: %s, path: %s)", properties.Path, path)
+			return errors.Wrapf(err, "writing header failed (path: %s)", f.Name)
 		}
 
-		if relativePath == "." {
-			return nil
+		if !f.Info.IsDir() {
+			err = writeFileContentToArchive(f, w)
+			if err != nil {
+				return errors.Wrapf(err, "archiving file content failed (path: %s)", f.Name)
+			}
 		}
+	}
+	return nil
+}
 
-		header, err := buildArchiveHeader(info, filepath.Join(rootDir, relativePath))
+// packageFiles returns the files and directories of the package in the given path.
+func packageFiles(packagePath string) ([]File, error) {
+	var files []File
+	err := filepath.Walk(packagePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return errors.Wrapf(err, "building archive header failed (path: %s)", relativePath)
+			return err
 		}
 
-		w, err = zipWriter.CreateHeader(header)
+		relativePath, err := filepath.Rel(packagePath, path)
 		if err != nil {
-			return errors.Wrapf(err, "writing header failed (path: %s)", relativePath)
+			return errors.Wrapf(err, "finding relative path failed (packagePath: %s, path: %s)", packagePath, path)
 		}
 
-		if !info.IsDir() {
-			err = writeFileContentToArchive(path, w)
-			if err != nil {
-				return errors.Wrapf(err, "archiving file content failed (path: %s)", path)
-			}
+		if relativePath == "." {
+			return nil
 		}
+
+		files = append(files, File{
+			Name: filepath.ToSlash(relativePath),
+			Info: info,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(path)
+			},
+		})
 		return nil
 	})
-	if err != nil {
-		return errors.Wrapf(err, "processing package path '%s' failed", properties.Path)
-	}
-
-	err = zipWriter.Flush()
-	if err != nil {
-		return errors.Wrap(err, "flushing zip writer failed")
-	}
-	return nil
-}
-
-func buildArchiveHeader(info os.FileInfo, relativePath string) (*zip.FileHeader, error) {
-	header, err := zip.FileInfoHeader(info)
-	if err != nil {
-		return nil, errors.Wrapf(err, "reading file info header failed (info: %s)", info.Name())
-	}
-
-	header.Method = zip.Deflate
-	header.Name = relativePath
-	if info.IsDir() && !strings.HasSuffix(header.Name, "/") {
-		header.Name = header.Name + "/"
-	}
-	return header, nil
+	return files, err
 }
 
-func writeFileContentToArchive(path string, writer io.Writer) (err error) {
-	var f *os.File
-	f, err = os.Open(path)
+func writeFileContentToArchive(file File, writer io.Writer) (err error) {
+	var f io.ReadCloser
+	f, err = file.Open()
 	if err != nil {
-		return errors.Wrapf(err, "opening file failed (path: %s)", path)
+		return errors.Wrapf(err, "opening file failed (path: %s)", file.Name)
 	}
 	defer func() {
 		var multiErr multierror.Errors
@@ -115,7 +179,7 @@ func writeFileContentToArchive(path string, writer io.Writer) (err error) {
 
 		err = f.Close()
 		if err != nil {
-			multiErr = append(multiErr, errors.Wrapf(err, "closing file failed (path: %s)", path))
+			multiErr = append(multiErr, errors.Wrapf(err, "closing file failed (path: %s)", file.Name))
 		}
 
 		if multiErr != nil {
@@ -125,7 +189,7 @@ func writeFileContentToArchive(path string, writer io.Writer) (err error) {
 
 	_, err = io.Copy(writer, f)
 	if err != nil {
-		return errors.Wrapf(err, "copying file content failed (path: %s)", path)
+		return errors.Wrapf(err, "copying file content failed (path: %s)", file.Name)
 	}
 	return nil
 }
@@ -0,0 +1,172 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package archiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPackagePath = "../testdata/package/example/1.0.0"
+
+func TestArchivePackageReproducible(t *testing.T) {
+	// Same content checked out twice, at different times and with different permissions.
+	first := copyPackage(t, testPackagePath, time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC), 0644)
+	second := copyPackage(t, testPackagePath, time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC), 0600)
+
+	firstChecksum := archiveChecksum(t, first, true)
+	assert.Equal(t, firstChecksum, archiveChecksum(t, first, true))
+	assert.Equal(t, firstChecksum, archiveChecksum(t, second, true))
+
+	// Without the reproducible mode, archives depend on the metadata of the files.
+	assert.NotEqual(t, archiveChecksum(t, first, false), archiveChecksum(t, second, false))
+
+	// Changes in content produce different archives.
+	err := ioutil.WriteFile(filepath.Join(second, "docs", "README.md"), []byte("# Changed"), 0644)
+	require.NoError(t, err)
+	assert.NotEqual(t, firstChecksum, archiveChecksum(t, second, true))
+}
+
+func TestArchivePackageReproducibleEntries(t *testing.T) {
+	var buf bytes.Buffer
+	err := ArchivePackage(&buf, PackageProperties{
+		Name:         "example",
+		Version:      "1.0.0",
+		Path:         testPackagePath,
+		Reproducible: true,
+	})
+	require.NoError(t, err)
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.NotEmpty(t, reader.File)
+
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+		assert.True(t, reproducibleModTime.Equal(f.Modified), f.Name)
+		if f.FileInfo().IsDir() {
+			assert.Equal(t, reproducibleDirMode, f.Mode(), f.Name)
+		} else {
+			assert.Equal(t, reproducibleFileMode, f.Mode(), f.Name)
+		}
+	}
+	assert.True(t, sort.StringsAreSorted(names), "entries should be sorted by name")
+	assert.Contains(t, names, "example-1.0.0/manifest.yml")
+}
+
+func TestArchivePackageTarGz(t *testing.T) {
+	var zipBuf, tarGzBuf bytes.Buffer
+	properties := PackageProperties{
+		Name:         "example",
+		Version:      "1.0.0",
+		Path:         testPackagePath,
+		Reproducible: true,
+	}
+	err := ArchivePackage(&zipBuf, properties)
+	require.NoError(t, err)
+	err = ArchivePackageTarGz(&tarGzBuf, properties)
+	require.NoError(t, err)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()))
+	require.NoError(t, err)
+	expected := make(map[string]string)
+	for _, f := range zipReader.File {
+		expected[f.Name] = readZipFile(t, f)
+	}
+
+	gzipReader, err := gzip.NewReader(&tarGzBuf)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	found := make(map[string]string)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.True(t, reproducibleModTime.Equal(header.ModTime), header.Name)
+
+		content, err := ioutil.ReadAll(tarReader)
+		require.NoError(t, err)
+		found[header.Name] = string(content)
+	}
+
+	// Both formats contain the same files.
+	assert.Equal(t, expected, found)
+}
+
+func readZipFile(t *testing.T, f *zip.File) string {
+	r, err := f.Open()
+	require.NoError(t, err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func archiveChecksum(t *testing.T, path string, reproducible bool) string {
+	h := sha256.New()
+	err := ArchivePackage(h, PackageProperties{
+		Name:         "example",
+		Version:      "1.0.0",
+		Path:         path,
+		Reproducible: reproducible,
+	})
+	require.NoError(t, err)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// copyPackage copies a package to a temporary directory, setting the same modification time and
+// permissions to all its files.
+func copyPackage(t *testing.T, src string, modTime time.Time, mode os.FileMode) string {
+	dst := t.TempDir()
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relativePath)
+		if info.IsDir() {
+			dirs = append(dirs, target)
+			return os.MkdirAll(target, 0755)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(target, content, mode)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, modTime, modTime)
+	})
+	require.NoError(t, err)
+
+	// Directories are updated after all files are written, so their times are not changed again.
+	for _, dir := range dirs {
+		err := os.Chtimes(dir, modTime, modTime)
+		require.NoError(t, err)
+	}
+	return dst
+}
@@ -0,0 +1,99 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package archiver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joeshaw/multierror"
+	"github.com/pkg/errors"
+)
+
+type tarGzWriter struct {
+	*tar.Writer
+
+	gzipWriter   *gzip.Writer
+	reproducible bool
+}
+
+func newTarGzWriter(w io.Writer, reproducible bool) (*tarGzWriter, error) {
+	level := gzip.DefaultCompression
+	if reproducible {
+		level = gzip.BestCompression
+	}
+	gzipWriter, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating gzip writer failed")
+	}
+	return &tarGzWriter{
+		Writer:       tar.NewWriter(gzipWriter),
+		gzipWriter:   gzipWriter,
+		reproducible: reproducible,
+	}, nil
+}
+
+func (w *tarGzWriter) create(name string, info os.FileInfo) (io.Writer, error) {
+	header, err := buildTarHeader(info, name, w.reproducible)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building tar header failed (path: %s)", name)
+	}
+	err = w.WriteHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return w.Writer, nil
+}
+
+// Close closes the tar writer and the gzip stream.
+func (w *tarGzWriter) Close() error {
+	var multiErr multierror.Errors
+	err := w.Writer.Close()
+	if err != nil {
+		multiErr = append(multiErr, errors.Wrap(err, "closing tar writer failed"))
+	}
+	err = w.gzipWriter.Close()
+	if err != nil {
+		multiErr = append(multiErr, errors.Wrap(err, "closing gzip writer failed"))
+	}
+	return multiErr.Err()
+}
+
+func buildTarHeader(info os.FileInfo, relativePath string, reproducible bool) (*tar.Header, error) {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, errors.Errorf("unsupported file type %s", info.Mode().Type())
+	}
+
+	var header *tar.Header
+	if reproducible {
+		header = &tar.Header{
+			Typeflag: tar.TypeReg,
+			Mode:     int64(reproducibleFileMode.Perm()),
+			Size:     info.Size(),
+			ModTime:  reproducibleModTime,
+			Format:   tar.FormatUSTAR,
+		}
+		if info.IsDir() {
+			header.Typeflag = tar.TypeDir
+			header.Mode = int64(reproducibleDirMode.Perm())
+			header.Size = 0
+		}
+	} else {
+		var err error
+		header, err = tar.FileInfoHeader(info, "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading file info header failed (info: %s)", info.Name())
+		}
+	}
+
+	header.Name = relativePath
+	if info.IsDir() && !strings.HasSuffix(header.Name, "/") {
+		header.Name = header.Name + "/"
+	}
+	return header, nil
+}
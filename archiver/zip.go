@@ -0,0 +1,67 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package archiver
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type zipWriter struct {
+	*zip.Writer
+
+	reproducible bool
+}
+
+func newZipWriter(w io.Writer, reproducible bool) *zipWriter {
+	writer := zip.NewWriter(w)
+	if reproducible {
+		writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, flate.BestCompression)
+		})
+	}
+	return &zipWriter{
+		Writer:       writer,
+		reproducible: reproducible,
+	}
+}
+
+func (w *zipWriter) create(name string, info os.FileInfo) (io.Writer, error) {
+	header, err := buildArchiveHeader(info, name, w.reproducible)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building archive header failed (path: %s)", name)
+	}
+	return w.CreateHeader(header)
+}
+
+func buildArchiveHeader(info os.FileInfo, relativePath string, reproducible bool) (*zip.FileHeader, error) {
+	var header *zip.FileHeader
+	if reproducible {
+		header = &zip.FileHeader{Modified: reproducibleModTime}
+		if info.IsDir() {
+			header.SetMode(reproducibleDirMode)
+		} else {
+			header.SetMode(reproducibleFileMode)
+		}
+	} else {
+		var err error
+		header, err = zip.FileInfoHeader(info)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading file info header failed (info: %s)", info.Name())
+		}
+	}
+
+	header.Method = zip.Deflate
+	header.Name = relativePath
+	if info.IsDir() && !strings.HasSuffix(header.Name, "/") {
+		header.Name = header.Name + "/"
+	}
+	return header, nil
+}
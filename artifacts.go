@@ -16,11 +16,28 @@ import (
 	"github.com/elastic/package-registry/packages"
 )
 
-const artifactsRouterPath = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.zip"
+const (
+	artifactsRouterPath      = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.zip"
+	tarGzArtifactsRouterPath = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.tar.gz"
+	checksumsRouterPath      = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.zip.sha256"
+)
 
 var errArtifactNotFound = errors.New("artifact not found")
 
 func artifactsHandler(indexer Indexer, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return packageArtifactHandler(indexer, cacheTime, countDownloads("zip", packages.ServePackage))
+}
+
+func tarGzArtifactsHandler(indexer Indexer, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return packageArtifactHandler(indexer, cacheTime, countDownloads("tar.gz", packages.ServePackageTarGz))
+}
+
+func checksumsHandler(indexer Indexer, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return packageArtifactHandler(indexer, cacheTime, packages.ServeChecksum)
+}
+
+// packageArtifactHandler looks for the package in the request, and serves it with the given function.
+func packageArtifactHandler(indexer Indexer, cacheTime time.Duration, serve func(http.ResponseWriter, *http.Request, *packages.Package)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		packageName, ok := vars["packageName"]
@@ -42,6 +59,7 @@ func artifactsHandler(indexer Indexer, cacheTime time.Duration) func(w http.Resp
 		}
 
 		opts := packages.NameVersionFilter(packageName, packageVersion)
+		restrictFilter(r.Context(), opts.Filter)
 		packageList, err := indexer.Get(r.Context(), &opts)
 		if err != nil {
 			log.Printf("getting package path failed: %v", err)
@@ -54,6 +72,6 @@ func artifactsHandler(indexer Indexer, cacheTime time.Duration) func(w http.Resp
 		}
 
 		cacheHeaders(w, cacheTime)
-		packages.ServePackage(w, r, packageList[0])
+		serve(w, r, packageList[0])
 	}
 }
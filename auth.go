@@ -0,0 +1,360 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+// Scopes that can be granted to requests.
+const (
+	// scopeRead allows to read packages and their metadata.
+	scopeRead = "read"
+
+	// scopeInternal allows to see internal packages.
+	scopeInternal = "internal"
+
+	// scopeWrite allows to use administration endpoints and to publish packages. It implies
+	// the read scope.
+	scopeWrite = "write"
+)
+
+var knownScopes = []string{scopeRead, scopeInternal, scopeWrite}
+
+// AuthConfig is the configuration of the authentication and authorization of requests.
+type AuthConfig struct {
+	Anonymous AnonymousConfig `config:"anonymous"`
+
+	// Static bearer tokens, with the grant of their bearers.
+	Tokens []TokenConfig `config:"tokens"`
+
+	// Secrets used to verify HMAC-signed tokens. These tokens are JWTs signed with HS256, their
+	// grant is included in their `scope` and `owners` claims. More than one secret can be
+	// configured, so they can be rotated.
+	HMACSecrets []string `config:"hmac.secrets"`
+}
+
+// AnonymousConfig is the configuration of what requests without token can do. By default they
+// can read all packages.
+type AnonymousConfig struct {
+	// If disabled, all requests need a token.
+	Disabled bool `config:"disabled"`
+
+	// If set, internal packages cannot be seen by anonymous requests.
+	HideInternal bool `config:"hide_internal"`
+
+	// If not empty, only packages of these GitHub owners can be seen by anonymous requests.
+	Owners []string `config:"owners"`
+}
+
+// TokenConfig is the configuration of a static bearer token.
+type TokenConfig struct {
+	Token  string   `config:"token" validate:"required"`
+	Scopes []string `config:"scopes"`
+
+	// If not empty, only packages of these GitHub owners can be seen with this token.
+	Owners []string `config:"owners"`
+}
+
+// authorization is what a request is allowed to do.
+type authorization struct {
+	scopes []string
+
+	// If not empty, only packages of these owners can be seen.
+	owners []string
+
+	// anonymous is set for requests without token.
+	anonymous bool
+}
+
+func (a *authorization) hasScope(scope string) bool {
+	for _, s := range a.scopes {
+		if s == scope || (scope == scopeRead && s == scopeWrite) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrict applies to the filter the restrictions in the packages that can be seen.
+func (a *authorization) restrict(filter *packages.Filter) {
+	if !a.hasScope(scopeInternal) {
+		filter.Internal = false
+	}
+	if len(a.owners) > 0 {
+		filter.Owners = a.owners
+	}
+}
+
+type authorizationContextKey struct{}
+
+// restrictFilter applies to the filter the restrictions of the authorization of the request.
+// Filters of requests that have not been authenticated are not modified.
+func restrictFilter(ctx context.Context, filter *packages.Filter) {
+	a, ok := ctx.Value(authorizationContextKey{}).(*authorization)
+	if !ok || filter == nil {
+		return
+	}
+	a.restrict(filter)
+}
+
+// authenticator authenticates requests with static and HMAC-signed bearer tokens.
+type authenticator struct {
+	anonymous   *authorization
+	tokens      []staticToken
+	hmacSecrets [][]byte
+
+	// now returns the current time, used to validate the lifetime of tokens.
+	now func() time.Time
+}
+
+type staticToken struct {
+	token         []byte
+	authorization *authorization
+}
+
+// newAuthenticator creates an authenticator for the tokens in the configuration. The admin
+// token, if set, is a static token with all the scopes.
+func newAuthenticator(config *Config) (*authenticator, error) {
+	a := authenticator{now: time.Now}
+	a.anonymous = &authorization{
+		owners:    config.Auth.Anonymous.Owners,
+		anonymous: true,
+	}
+	if !config.Auth.Anonymous.Disabled {
+		a.anonymous.scopes = append(a.anonymous.scopes, scopeRead)
+		if !config.Auth.Anonymous.HideInternal {
+			a.anonymous.scopes = append(a.anonymous.scopes, scopeInternal)
+		}
+	}
+
+	if config.AdminToken != "" {
+		a.tokens = append(a.tokens, staticToken{
+			token:         []byte(config.AdminToken),
+			authorization: &authorization{scopes: knownScopes},
+		})
+	}
+	for i, token := range config.Auth.Tokens {
+		err := validateScopes(token.Scopes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid auth token %d", i)
+		}
+		a.tokens = append(a.tokens, staticToken{
+			token: []byte(token.Token),
+			authorization: &authorization{
+				scopes: token.Scopes,
+				owners: token.Owners,
+			},
+		})
+	}
+	for _, secret := range config.Auth.HMACSecrets {
+		if secret == "" {
+			return nil, errors.New("empty HMAC secret")
+		}
+		a.hmacSecrets = append(a.hmacSecrets, []byte(secret))
+	}
+	if config.Auth.Anonymous.Disabled && len(a.tokens) == 0 && len(a.hmacSecrets) == 0 {
+		// No request could be authorized.
+		return nil, errors.New("auth.anonymous.disabled requires auth tokens or HMAC secrets")
+	}
+	return &a, nil
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range knownScopes {
+			if s == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(knownScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// hasTokens returns true if requests can be authenticated with tokens.
+func (a *authenticator) hasTokens() bool {
+	return len(a.tokens) > 0 || len(a.hmacSecrets) > 0
+}
+
+// authenticate returns the authorization of the request. It fails if the request has a token
+// that is not valid.
+func (a *authenticator) authenticate(r *http.Request) (*authorization, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return a.anonymous, nil
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(authHeader, prefix) {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+	token := strings.TrimPrefix(authHeader, prefix)
+
+	// All static tokens are compared, so the time taken doesn't depend on the token found.
+	var found *authorization
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), t.token) == 1 {
+			found = t.authorization
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+
+	if len(a.hmacSecrets) > 0 && strings.Count(token, ".") == 2 {
+		return a.verifyHMACToken(token)
+	}
+	return nil, errors.New("unknown token")
+}
+
+// hmacTokenHeader is the header of HMAC-signed tokens.
+type hmacTokenHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+// hmacTokenClaims are the claims of HMAC-signed tokens used by the registry.
+type hmacTokenClaims struct {
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Owners    []string `json:"owners"`
+}
+
+// verifyHMACToken verifies a JWT signed with HS256 with any of the configured secrets, and
+// returns the authorization granted by its claims.
+func (a *authenticator) verifyHMACToken(token string) (*authorization, error) {
+	parts := strings.Split(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token signature failed")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	valid := false
+	for _, secret := range a.hmacSecrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var header hmacTokenHeader
+	err = decodeTokenPart(parts[0], &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token header failed")
+	}
+	if header.Algorithm != "HS256" {
+		return nil, errors.Errorf("unsupported token algorithm %q", header.Algorithm)
+	}
+
+	var claims hmacTokenClaims
+	err = decodeTokenPart(parts[1], &claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token claims failed")
+	}
+	now := a.now().Unix()
+	if claims.ExpiresAt == 0 {
+		// Tokens without expiration would be valid forever, even after being leaked.
+		return nil, errors.New("token without expiration time")
+	}
+	if now >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	err = validateScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	return &authorization{
+		scopes: scopes,
+		owners: claims.Owners,
+	}, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	d, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
+
+// authMiddleware authenticates requests, and stores their authorization in their context.
+// Requests with invalid tokens are rejected, and the rest of requests need the read scope,
+// except the ones to the health endpoint.
+func authMiddleware(a *authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if a.hasTokens() {
+				// Responses can depend on the token, they cannot be shared between tokens.
+				addVary(w.Header(), "Authorization")
+			}
+
+			authorization, err := a.authenticate(r)
+			if err != nil {
+				unauthorized(w)
+				return
+			}
+			if !authorization.hasScope(scopeRead) {
+				forbidden(w, authorization)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), authorizationContextKey{}, authorization)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requireScope only calls the handler if the request is authorized with the given scope.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization, ok := r.Context().Value(authorizationContextKey{}).(*authorization)
+		if !ok || !authorization.hasScope(scope) {
+			forbidden(w, authorization)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// forbidden responds to requests without the needed scope. Anonymous requests are asked to
+// authenticate.
+func forbidden(w http.ResponseWriter, authorization *authorization) {
+	if authorization == nil || authorization.anonymous {
+		unauthorized(w)
+		return
+	}
+	noCacheHeaders(w)
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
@@ -0,0 +1,170 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestAuth(t *testing.T) {
+	const hmacSecret = "hmac-secret"
+
+	config := defaultConfig
+	config.AdminToken = "admin"
+	config.Auth = AuthConfig{
+		Anonymous: AnonymousConfig{HideInternal: true},
+		Tokens: []TokenConfig{
+			{Token: "reader", Scopes: []string{scopeRead}},
+			{Token: "internal", Scopes: []string{scopeRead, scopeInternal}},
+			{Token: "owner", Scopes: []string{scopeRead, scopeInternal}, Owners: []string{"ruflin"}},
+		},
+		HMACSecrets: []string{"old-secret", hmacSecret},
+	}
+	router := newTestAuthRouter(t, &config)
+
+	now := time.Now()
+	writeToken := newTestHMACToken(t, hmacSecret, hmacTokenClaims{Scope: "write", ExpiresAt: now.Add(time.Hour).Unix()})
+	internalToken := newTestHMACToken(t, hmacSecret, hmacTokenClaims{Scope: "read internal", ExpiresAt: now.Add(time.Hour).Unix()})
+	expiredToken := newTestHMACToken(t, hmacSecret, hmacTokenClaims{Scope: "read", ExpiresAt: now.Add(-time.Hour).Unix()})
+	futureToken := newTestHMACToken(t, hmacSecret, hmacTokenClaims{Scope: "read", ExpiresAt: now.Add(2 * time.Hour).Unix(), NotBefore: now.Add(time.Hour).Unix()})
+	otherSecretToken := newTestHMACToken(t, "other-secret", hmacTokenClaims{Scope: "read", ExpiresAt: now.Add(time.Hour).Unix()})
+	noExpirationToken := newTestHMACToken(t, hmacSecret, hmacTokenClaims{Scope: "read"})
+
+	cases := []struct {
+		title    string
+		token    string
+		endpoint string
+		status   int
+	}{
+		{"anonymous can read", "", "/package/example/1.0.0/", http.StatusOK},
+		{"anonymous cannot see internal packages", "", "/package/internal/1.2.0/", http.StatusNotFound},
+		{"anonymous cannot download internal packages", "", "/epr/internal/internal-1.2.0.zip", http.StatusNotFound},
+		{"anonymous cannot use admin endpoints", "", cacheStatsRouterPath, http.StatusUnauthorized},
+		{"health doesn't need token", "unknown", "/health", http.StatusOK},
+		{"unknown token", "unknown", "/package/example/1.0.0/", http.StatusUnauthorized},
+		{"reader cannot see internal packages", "reader", "/package/internal/1.2.0/", http.StatusNotFound},
+		{"reader cannot use admin endpoints", "reader", cacheStatsRouterPath, http.StatusForbidden},
+		{"internal scope", "internal", "/package/internal/1.2.0/", http.StatusOK},
+		{"owner can see its packages", "owner", "/package/example/1.0.0/", http.StatusOK},
+		{"owner cannot see other packages", "owner", "/package/datasources/1.0.0/", http.StatusNotFound},
+		{"admin token", "admin", cacheStatsRouterPath, http.StatusOK},
+		{"hmac token with write scope", writeToken, cacheStatsRouterPath, http.StatusOK},
+		{"hmac token with write scope can read", writeToken, "/package/example/1.0.0/", http.StatusOK},
+		{"hmac token with internal scope", internalToken, "/package/internal/1.2.0/", http.StatusOK},
+		{"hmac token without write scope", internalToken, cacheStatsRouterPath, http.StatusForbidden},
+		{"expired hmac token", expiredToken, "/package/example/1.0.0/", http.StatusUnauthorized},
+		{"hmac token without expiration", noExpirationToken, "/package/example/1.0.0/", http.StatusUnauthorized},
+		{"hmac token not valid yet", futureToken, "/package/example/1.0.0/", http.StatusUnauthorized},
+		{"hmac token with unknown secret", otherSecretToken, "/package/example/1.0.0/", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			recorder := serveWithToken(router, c.token, c.endpoint)
+			assert.Equal(t, c.status, recorder.Code, recorder.Body.String())
+		})
+	}
+
+	t.Run("search", func(t *testing.T) {
+		const endpoint = "/search?package=internal&internal=true"
+		assert.Empty(t, searchedPackages(t, router, "", endpoint))
+		assert.Equal(t, []string{"internal"}, searchedPackages(t, router, "internal", endpoint))
+		assert.Equal(t, []string{"example", "reference"}, searchedPackages(t, router, "owner", "/search?internal=true&experimental=true"))
+	})
+}
+
+func TestAuthAnonymousDisabled(t *testing.T) {
+	config := defaultConfig
+	config.Auth = AuthConfig{
+		Anonymous: AnonymousConfig{Disabled: true},
+		Tokens: []TokenConfig{
+			{Token: "reader", Scopes: []string{scopeRead}},
+			{Token: "internal-only", Scopes: []string{scopeInternal}},
+		},
+	}
+	router := newTestAuthRouter(t, &config)
+
+	assert.Equal(t, http.StatusUnauthorized, serveWithToken(router, "", "/search").Code)
+	assert.Equal(t, http.StatusForbidden, serveWithToken(router, "internal-only", "/search").Code)
+	assert.Equal(t, http.StatusOK, serveWithToken(router, "reader", "/search").Code)
+	assert.Equal(t, http.StatusOK, serveWithToken(router, "", "/health").Code)
+}
+
+func TestAuthInvalidScope(t *testing.T) {
+	config := defaultConfig
+	config.Auth.Tokens = []TokenConfig{{Token: "token", Scopes: []string{"admin"}}}
+	_, err := newAuthenticator(&config)
+	assert.Error(t, err)
+}
+
+func TestAuthAnonymousDisabledWithoutTokens(t *testing.T) {
+	config := defaultConfig
+	config.Auth.Anonymous.Disabled = true
+	_, err := newAuthenticator(&config)
+	assert.Error(t, err)
+}
+
+func newTestAuthRouter(t *testing.T, config *Config) http.Handler {
+	indexer := packages.NewFileSystemIndexer("./testdata/package")
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	router, err := getRouter(config, indexer, nil)
+	require.NoError(t, err)
+	return router
+}
+
+func serveWithToken(handler http.Handler, token, endpoint string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, endpoint, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func searchedPackages(t *testing.T, handler http.Handler, token, endpoint string) []string {
+	t.Helper()
+	recorder := serveWithToken(handler, token, endpoint)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var result []packages.BasePackage
+	err := json.Unmarshal(recorder.Body.Bytes(), &result)
+	require.NoError(t, err)
+
+	var names []string
+	for _, p := range result {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestHMACToken(t *testing.T, secret string, claims hmacTokenClaims) string {
+	encode := func(v interface{}) string {
+		d, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(d)
+	}
+	signed := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
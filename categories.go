@@ -27,7 +27,7 @@ type Category struct {
 }
 
 // categoriesHandler is a dynamic handler as it will also allow filtering in the future.
-func categoriesHandler(indexer Indexer, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+func categoriesHandler(indexer Indexer, cache *responseCache, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 
@@ -36,6 +36,7 @@ func categoriesHandler(indexer Indexer, cacheTime time.Duration) func(w http.Res
 			badRequest(w, err.Error())
 			return
 		}
+		restrictFilter(r.Context(), filter)
 
 		includePolicyTemplates := false
 		if v := query.Get("include_policy_templates"); v != "" {
@@ -46,26 +47,32 @@ func categoriesHandler(indexer Indexer, cacheTime time.Duration) func(w http.Res
 			}
 		}
 
-		opts := packages.GetOptions{
-			Filter: filter,
-		}
-		packages, err := indexer.Get(r.Context(), &opts)
-		if err != nil {
-			notFoundError(w, err)
-			return
-		}
+		key := fmt.Sprintf("categories:%s,include_policy_templates=%t", filter.Key(), includePolicyTemplates)
+		response, ok := cache.getOrBuild(indexer, key, func() (*cachedResponse, bool) {
+			opts := packages.GetOptions{
+				Filter: filter,
+			}
+			packages, err := indexer.Get(r.Context(), &opts)
+			if err != nil {
+				notFoundError(w, err)
+				return nil, false
+			}
 
-		categories := getCategories(r.Context(), packages, includePolicyTemplates)
+			categories := getCategories(r.Context(), packages, includePolicyTemplates)
 
-		data, err := getCategoriesOutput(r.Context(), categories)
-		if err != nil {
-			notFoundError(w, err)
+			data, err := getCategoriesOutput(r.Context(), categories)
+			if err != nil {
+				notFoundError(w, err)
+				return nil, false
+			}
+			return &cachedResponse{json: newJSONResponse(data)}, true
+		})
+		if !ok {
 			return
 		}
 
 		cacheHeaders(w, cacheTime)
-		jsonHeader(w)
-		w.Write(data)
+		response.json.serve(w, r)
 	}
 }
 
@@ -91,6 +98,29 @@ func newCategoriesFilterFromQuery(query url.Values) (*packages.Filter, error) {
 		}
 	}
 
+	if v := query.Get("type"); v != "" {
+		filter.PackageType = v
+	}
+
+	if v := query.Get("release"); v != "" {
+		if !packages.IsValidRelease(v) {
+			return nil, fmt.Errorf("invalid 'release' query param: '%s'", v)
+		}
+		filter.Release = v
+	}
+
+	if v := query.Get("owner"); v != "" {
+		filter.Owner = v
+	}
+
+	if v := query.Get("data_stream.type"); v != "" {
+		filter.DataStreamType = v
+	}
+
+	if v := query.Get("input"); v != "" {
+		filter.Input = v
+	}
+
 	return &filter, nil
 }
 
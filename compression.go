@@ -0,0 +1,270 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+
+	// Responses smaller than this are not compressed, if their size is known.
+	minCompressSize = 1024
+
+	// Brotli compression level used for precompressed responses.
+	brotliPrecompressionLevel = 9
+)
+
+// supportedEncodings is the list of supported content encodings, in order of preference.
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+// encoder is a compressor that can be reused for different responses.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	encodingBrotli: {New: func() interface{} { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }},
+	encodingGzip:   {New: func() interface{} { return gzip.NewWriter(nil) }},
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	e := encoderPools[encoding].Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+func putEncoder(encoding string, e encoder) {
+	e.Reset(nil)
+	encoderPools[encoding].Put(e)
+}
+
+// compressBody compresses a body with the given encoding. If best is set, a better compression
+// level is used, what is slower, but worth it for bodies that are compressed once and served
+// many times.
+func compressBody(encoding string, body []byte, best bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var e encoder
+	switch {
+	case !best:
+		e = getEncoder(encoding, &buf)
+		defer putEncoder(encoding, e)
+	case encoding == encodingBrotli:
+		// Maximum level is too slow for large bodies compressed while handling a request.
+		e = brotli.NewWriterLevel(&buf, brotliPrecompressionLevel)
+	case encoding == encodingGzip:
+		e, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	default:
+		return nil, errors.Errorf("unsupported encoding %q", encoding)
+	}
+
+	_, err := e.Write(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compressing body with %s failed", encoding)
+	}
+	err = e.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "compressing body with %s failed", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding selects the preferred content encoding accepted by the client, as
+// indicated in the Accept-Encoding header. It returns an empty string if the response
+// should not be compressed.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err == nil {
+				q = v
+			}
+		}
+		accepted[coding] = q
+	}
+
+	selected, selectedQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, found := accepted[encoding]
+		if !found {
+			q, found = accepted["*"]
+		}
+		if found && q > selectedQ {
+			selected, selectedQ = encoding, q
+		}
+	}
+	return selected
+}
+
+// encodedETag returns the ETag of the representation of a resource compressed with the given
+// encoding, so it is different to the ETag of the uncompressed representation.
+func encodedETag(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// addVary adds a header name to the Vary header, if it is not already there.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// compressionMiddleware compresses responses with an encoding accepted by the client. Responses
+// that are already compressed, or whose content is already compressed, are not modified.
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides if the response has to be compressed when the headers are
+// written, and compresses the body in that case.
+type compressResponseWriter struct {
+	http.ResponseWriter
+
+	encoding    string
+	encoder     encoder
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if !isCompressedMimeType(header.Get("Content-Type")) {
+		addVary(header, "Accept-Encoding")
+	}
+	if compressibleResponse(code, header) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		if etag := header.Get("ETag"); etag != "" {
+			header.Set("ETag", encodedETag(etag, w.encoding))
+		}
+		w.encoder = getEncoder(w.encoding, w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.encoder.Write(p)
+}
+
+// Flush sends to the client the data compressed till now.
+func (w *compressResponseWriter) Flush() {
+	if w.encoder != nil {
+		if f, ok := w.encoder.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows to take over the connection, if supported by the underlying writer.
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+// close completes the compressed body, it must be called after the handler returns.
+func (w *compressResponseWriter) close() {
+	if w.encoder == nil {
+		return
+	}
+	w.encoder.Close()
+	putEncoder(w.encoding, w.encoder)
+	w.encoder = nil
+}
+
+// compressibleResponse checks if a response can be compressed, based on its status code and headers.
+func compressibleResponse(code int, header http.Header) bool {
+	switch {
+	case code < http.StatusOK, code == http.StatusNoContent, code == http.StatusNotModified:
+		// Responses without body.
+		return false
+	case code == http.StatusPartialContent, header.Get("Content-Range") != "":
+		// Ranges refer to the uncompressed content.
+		return false
+	case header.Get("Content-Encoding") != "":
+		// Already encoded by the handler.
+		return false
+	case isCompressedMimeType(header.Get("Content-Type")):
+		return false
+	}
+
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err == nil && n < minCompressSize {
+			return false
+		}
+	}
+	return true
+}
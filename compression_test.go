@@ -0,0 +1,155 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", encodingGzip},
+		{"GZIP", encodingGzip},
+		{"gzip, deflate, br", encodingBrotli},
+		{"gzip;q=1.0, br;q=0.5", encodingGzip},
+		{"br;q=0, gzip", encodingGzip},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", encodingBrotli},
+		{"*;q=0.5, br;q=0", encodingGzip},
+		{"deflate", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.acceptEncoding, func(t *testing.T) {
+			assert.Equal(t, c.expected, negotiateEncoding(c.acceptEncoding))
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	config := Config{
+		CacheTimeIndex:      testCacheTime,
+		CacheTimeSearch:     testCacheTime,
+		CacheTimeCategories: testCacheTime,
+		CacheTimeCatchAll:   testCacheTime,
+	}
+	indexer := packages.NewFileSystemIndexer("./testdata/package")
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+	router, err := getRouter(&config, indexer, nil)
+	require.NoError(t, err)
+
+	cases := []struct {
+		endpoint         string
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"/search?all=true", "", ""},
+		{"/search?all=true", "gzip", encodingGzip},
+		{"/search?all=true", "gzip, br", encodingBrotli},
+		{"/package/example/1.0.0/", "gzip", encodingGzip},
+		{"/package/example/1.0.0/data_stream/foo/elasticsearch/ingest_pipeline/pipeline-plaintext.json", "br", encodingBrotli},
+		{"/package/example/1.0.0/img/icon.png", "gzip, br", ""},
+		{"/package/example/1.0.0/img/kibana-envoyproxy.jpg", "gzip, br", ""},
+		{"/epr/example/example-0.0.2.zip", "gzip, br", ""},
+
+		// Too small to be worth compressing.
+		{"/", "gzip, br", ""},
+		{"/package/example/1.0.0/docs/README.md", "gzip, br", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.endpoint+" "+c.acceptEncoding, func(t *testing.T) {
+			expected := httptest.NewRecorder()
+			router.ServeHTTP(expected, httptest.NewRequest(http.MethodGet, c.endpoint, nil))
+			require.Equal(t, http.StatusOK, expected.Code)
+
+			req := httptest.NewRequest(http.MethodGet, c.endpoint, nil)
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, c.expectedEncoding, recorder.Header().Get("Content-Encoding"))
+			assert.Equal(t, expected.Header().Get("Content-Type"), recorder.Header().Get("Content-Type"))
+			if c.expectedEncoding != "" {
+				assert.Contains(t, recorder.Header().Values("Vary"), "Accept-Encoding")
+			}
+
+			body := decodeBody(t, c.expectedEncoding, recorder.Body)
+			assert.Equal(t, expected.Body.Bytes(), body)
+
+			etag := recorder.Header().Get("ETag")
+			if etag == "" {
+				return
+			}
+			if c.expectedEncoding != "" {
+				assert.NotEqual(t, expected.Header().Get("ETag"), etag)
+			}
+
+			req = httptest.NewRequest(http.MethodGet, c.endpoint, nil)
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+			req.Header.Set("If-None-Match", etag)
+			recorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			assert.Equal(t, http.StatusNotModified, recorder.Code)
+			assert.Empty(t, recorder.Body.Bytes())
+		})
+	}
+}
+
+func TestPrecompressedJSONResponse(t *testing.T) {
+	body := []byte(`{"items": [` + strings.Repeat(`"item", `, 1000) + `"item"]}`)
+	response, err := newPrecompressedJSONResponse(body)
+	require.NoError(t, err)
+	assert.Len(t, response.precompressed, len(supportedEncodings))
+
+	for _, encoding := range supportedEncodings {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		recorder := httptest.NewRecorder()
+		response.serve(recorder, req)
+
+		assert.Equal(t, encoding, recorder.Header().Get("Content-Encoding"))
+		assert.Equal(t, encodedETag(response.etag, encoding), recorder.Header().Get("ETag"))
+		assert.Equal(t, body, decodeBody(t, encoding, recorder.Body))
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body io.Reader) []byte {
+	var reader io.Reader
+	switch encoding {
+	case "":
+		reader = body
+	case encodingGzip:
+		gzipReader, err := gzip.NewReader(body)
+		require.NoError(t, err)
+		reader = gzipReader
+	case encodingBrotli:
+		reader = brotli.NewReader(body)
+	default:
+		t.Fatalf("unexpected encoding %q", encoding)
+	}
+	d, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return d
+}
@@ -5,10 +5,18 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 )
 
@@ -30,6 +38,12 @@ func badRequest(w http.ResponseWriter, errorMessage string) {
 	http.Error(w, errorMessage, http.StatusBadRequest)
 }
 
+func unauthorized(w http.ResponseWriter) {
+	noCacheHeaders(w)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
 func cacheHeaders(w http.ResponseWriter, cacheTime time.Duration) {
 	maxAge := fmt.Sprintf("max-age=%.0f", cacheTime.Seconds())
 	w.Header().Add("Cache-Control", maxAge)
@@ -44,3 +58,178 @@ func noCacheHeaders(w http.ResponseWriter) {
 func jsonHeader(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 }
+
+// writeJSON writes a JSON body with a strong ETag computed from its content. If the request
+// has an If-None-Match header matching the ETag, a 304 Not Modified response is sent instead.
+func writeJSON(w http.ResponseWriter, r *http.Request, body []byte) {
+	newJSONResponse(body).serve(w, r)
+}
+
+// jsonResponse is a JSON body, with its ETag and optionally its compressed variants.
+type jsonResponse struct {
+	body []byte
+	etag string
+
+	// precompressed contains the compressed variants of the body by encoding, if they were
+	// precomputed. Encodings not included here don't reduce the size of the body.
+	precompressed map[string][]byte
+}
+
+func newJSONResponse(body []byte) *jsonResponse {
+	return &jsonResponse{
+		body: body,
+		etag: bodyETag(body),
+	}
+}
+
+// newPrecompressedJSONResponse builds a JSON response with all its compressed variants, so they
+// don't need to be compressed every time the response is served.
+func newPrecompressedJSONResponse(body []byte) (*jsonResponse, error) {
+	response := newJSONResponse(body)
+	response.precompressed = make(map[string][]byte)
+	if len(body) < minCompressSize {
+		return response, nil
+	}
+	for _, encoding := range supportedEncodings {
+		compressed, err := compressBody(encoding, body, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(body) {
+			response.precompressed[encoding] = compressed
+		}
+	}
+	return response, nil
+}
+
+// serve writes the response, compressed if the client accepts it. Responses that were not
+// precompressed are compressed on the fly.
+func (j *jsonResponse) serve(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	addVary(header, "Accept-Encoding")
+
+	encoding := j.encoding(negotiateEncoding(r.Header.Get("Accept-Encoding")))
+	etag := j.etag
+	if encoding != "" {
+		etag = encodedETag(etag, encoding)
+	}
+	header.Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body := j.body
+	if encoding != "" {
+		compressed, err := j.compressed(encoding)
+		if err != nil {
+			log.Printf("compressing response failed: %v", err)
+			header.Set("ETag", j.etag)
+		} else {
+			body = compressed
+			header.Set("Content-Encoding", encoding)
+		}
+	}
+
+	jsonHeader(w)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// encoding returns the encoding used to serve the response when the client prefers the given
+// one, or an empty string if it has to be served uncompressed.
+func (j *jsonResponse) encoding(preferred string) string {
+	switch {
+	case preferred == "":
+		return ""
+	case j.precompressed != nil:
+		if _, found := j.precompressed[preferred]; !found {
+			return ""
+		}
+	case len(j.body) < minCompressSize:
+		return ""
+	}
+	return preferred
+}
+
+func (j *jsonResponse) compressed(encoding string) ([]byte, error) {
+	if j.precompressed != nil {
+		return j.precompressed[encoding], nil
+	}
+	return compressBody(encoding, j.body, false)
+}
+
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches checks if the ETag matches any of the ETags in an If-None-Match header. As
+// specified for If-None-Match, weak comparison is used.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTemplate returns the template of the route matched by the request, so requests to
+// the same endpoint are grouped independently of the values of their variables.
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
+
+// statusResponseWriter keeps the status code and the size of the body of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+
+	code        int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends to the client the data written till now, if supported by the underlying writer.
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows to take over the connection, if supported by the underlying writer.
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
@@ -12,22 +12,38 @@ import (
 )
 
 type indexData struct {
-	ServiceName string `json:"service.name"`
-	Version     string `json:"service.version"`
+	ServiceName string               `json:"service.name"`
+	Version     string               `json:"service.version"`
+	Signatures  *indexSignaturesData `json:"signatures,omitempty"`
 }
 
-func indexHandler(cacheTime time.Duration) (func(w http.ResponseWriter, r *http.Request), error) {
+// indexSignaturesData advertises where clients can find the material to verify signatures.
+type indexSignaturesData struct {
+	PublicKey     string `json:"public_key"`
+	PublicKeyInfo string `json:"public_key_info"`
+}
+
+func indexHandler(cacheTime time.Duration, signatures bool) (func(w http.ResponseWriter, r *http.Request), error) {
 	data := indexData{
 		ServiceName: serviceName,
 		Version:     version,
 	}
+	if signatures {
+		data.Signatures = &indexSignaturesData{
+			PublicKey:     publicKeyRouterPath,
+			PublicKeyInfo: publicKeyInfoRouterPath,
+		}
+	}
 	body, err := util.MarshalJSONPretty(&data)
 	if err != nil {
 		return nil, err
 	}
+	response, err := newPrecompressedJSONResponse(body)
+	if err != nil {
+		return nil, err
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
 		cacheHeaders(w, cacheTime)
-		w.Write(body)
+		response.serve(w, r)
 	}, nil
 }
@@ -6,6 +6,10 @@ package main
 
 import (
 	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/elastic/package-registry/packages"
 )
@@ -15,6 +19,68 @@ type Indexer interface {
 	Get(context.Context, *packages.GetOptions) (packages.Packages, error)
 }
 
+// Watcher is implemented by indexers that can reload their packages when they change.
+type Watcher interface {
+	Watch(ctx context.Context, pollInterval time.Duration)
+}
+
+// Reloader is implemented by indexers that can load their packages skipping the ones
+// that cannot be loaded.
+type Reloader interface {
+	Reload(ctx context.Context) (failed int, err error)
+}
+
+// Searchable is implemented by indexers that keep a search index of their packages.
+type Searchable interface {
+	SearchIndex() *packages.SearchIndex
+}
+
+// Versioned is implemented by indexers that can tell when their list of packages changes.
+type Versioned interface {
+	// PackagesVersion returns a number that changes every time the list of packages changes.
+	PackagesVersion() uint64
+}
+
+// Publisher is implemented by indexers that can publish uploaded packages.
+type Publisher interface {
+	StagePackage(r io.Reader) (*packages.StagedPackage, error)
+}
+
+// Labeled is implemented by indexers that can tell their kind, to identify them in metrics.
+type Labeled interface {
+	Label() string
+}
+
+// findPublisher returns the indexer that publishes uploaded packages, if any. For combined
+// indexers, the first one that can publish packages is returned.
+func findPublisher(indexer Indexer) Publisher {
+	switch indexer := indexer.(type) {
+	case CombinedIndexer:
+		for _, indexer := range indexer {
+			if publisher := findPublisher(indexer); publisher != nil {
+				return publisher
+			}
+		}
+	case Publisher:
+		return indexer
+	}
+	return nil
+}
+
+// packagesVersion returns the version of the list of packages of an indexer, if it supports it.
+func packagesVersion(indexer Indexer) (uint64, bool) {
+	switch indexer := indexer.(type) {
+	case CombinedIndexer:
+		return indexer.packagesVersion()
+	case Versioned:
+		return indexer.PackagesVersion(), true
+	}
+	return 0, false
+}
+
+// CombinedIndexer combines the packages of multiple indexers. If the same version of a package
+// is available in more than one indexer, the one in the first indexer takes precedence, and the
+// others are shadowed.
 type CombinedIndexer []Indexer
 
 func NewCombinedIndexer(indexers ...Indexer) CombinedIndexer {
@@ -28,17 +94,150 @@ func (c CombinedIndexer) Init(ctx context.Context) error {
 			return err
 		}
 	}
-	return nil
+	return c.logShadowed(ctx)
+}
+
+// Reload reloads the indexers, it returns the number of packages that couldn't be loaded.
+// Indexers that don't support reloading are initialized again.
+func (c CombinedIndexer) Reload(ctx context.Context) (int, error) {
+	var failed int
+	for _, indexer := range c {
+		reloader, ok := indexer.(Reloader)
+		if !ok {
+			err := indexer.Init(ctx)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := reloader.Reload(ctx)
+		if err != nil {
+			return 0, err
+		}
+		failed += n
+	}
+	return failed, c.logShadowed(ctx)
 }
 
+// Get returns the packages of all the indexers, without the shadowed ones. Filters are applied
+// after combining the packages, so they are applied to the packages of all indexers at once.
 func (c CombinedIndexer) Get(ctx context.Context, opts *packages.GetOptions) (packages.Packages, error) {
 	var packages packages.Packages
 	for _, indexer := range c {
-		p, err := indexer.Get(ctx, opts)
+		p, err := indexer.Get(ctx, nil)
 		if err != nil {
 			return nil, err
 		}
 		packages = packages.Join(p)
 	}
+
+	if opts != nil && opts.Filter != nil {
+		return opts.Filter.WithSearchIndexes(c.searchIndexes()...).Apply(ctx, packages), nil
+	}
 	return packages, nil
 }
+
+// searchIndexes returns the search indexes of the indexers. If any indexer doesn't have
+// a search index, none is returned, so an index is built for all the packages if needed.
+func (c CombinedIndexer) searchIndexes() []*packages.SearchIndex {
+	var indexes []*packages.SearchIndex
+	for _, indexer := range c {
+		searchable, ok := indexer.(Searchable)
+		if !ok {
+			return nil
+		}
+		indexes = append(indexes, searchable.SearchIndex())
+	}
+	return indexes
+}
+
+// packagesVersion returns a number that changes every time the list of packages of any of
+// the indexers changes. If any indexer doesn't support versioning, it returns false.
+func (c CombinedIndexer) packagesVersion() (uint64, bool) {
+	// Versions of each indexer only increase, so their sum changes if any of them changes.
+	var version uint64
+	for _, indexer := range c {
+		v, ok := packagesVersion(indexer)
+		if !ok {
+			return 0, false
+		}
+		version += v
+	}
+	return version, true
+}
+
+// countPackages returns the number of packages loaded by each kind of indexer, including
+// shadowed packages. Indexers that cannot tell their kind are not counted.
+func (c CombinedIndexer) countPackages(ctx context.Context) map[string]int {
+	count := make(map[string]int)
+	for _, indexer := range c {
+		labeled, ok := indexer.(Labeled)
+		if !ok {
+			continue
+		}
+		p, err := indexer.Get(ctx, nil)
+		if err != nil {
+			log.Printf("warning: counting packages of %s failed: %v", labeled.Label(), err)
+			continue
+		}
+		count[labeled.Label()] += len(p)
+	}
+	return count
+}
+
+// Shadowed returns the packages that are not served because the same version is available
+// in an indexer with higher precedence.
+func (c CombinedIndexer) Shadowed(ctx context.Context) (packages.Packages, error) {
+	var joined, shadowed packages.Packages
+	for _, indexer := range c {
+		p, err := indexer.Get(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		var s packages.Packages
+		joined, s = joined.JoinShadowed(p)
+		shadowed = append(shadowed, s...)
+	}
+	return shadowed, nil
+}
+
+func (c CombinedIndexer) logShadowed(ctx context.Context) error {
+	shadowed, err := c.Shadowed(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range shadowed {
+		log.Printf("%-20s\t%10s\t%s", p.Name+" (shadowed)", p.Version, p.BasePath)
+	}
+	return nil
+}
+
+// Watch watches for changes the indexers that support it, until the context is done.
+// File system indexers share a single watcher, as they usually watch the same paths.
+func (c CombinedIndexer) Watch(ctx context.Context, pollInterval time.Duration) {
+	var wg sync.WaitGroup
+	var fileSystemIndexers []*packages.FileSystemIndexer
+	for _, indexer := range c {
+		if indexer, ok := indexer.(*packages.FileSystemIndexer); ok {
+			fileSystemIndexers = append(fileSystemIndexers, indexer)
+			continue
+		}
+		watcher, ok := indexer.(Watcher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(watcher Watcher) {
+			defer wg.Done()
+			watcher.Watch(ctx, pollInterval)
+		}(watcher)
+	}
+	if len(fileSystemIndexers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packages.WatchFileSystemIndexers(ctx, pollInterval, fileSystemIndexers...)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,100 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/archiver"
+	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
+)
+
+func TestCombinedIndexerPrecedence(t *testing.T) {
+	// The same version of the package is available extracted in one path, and zipped in other.
+	zipPath := t.TempDir()
+	f, err := os.Create(filepath.Join(zipPath, "example-1.0.0.zip"))
+	require.NoError(t, err)
+	err = archiver.ArchivePackage(f, archiver.PackageProperties{
+		Name:    "example",
+		Version: "1.0.0",
+		Path:    "./testdata/package/example/1.0.0",
+	})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	extractedPath := t.TempDir()
+	require.NoError(t, util.CopyDir("./testdata/package/example/1.0.0", filepath.Join(extractedPath, "example", "1.0.0")))
+
+	cases := []struct {
+		precedence       string
+		expectedPath     string
+		expectedShadowed string
+	}{
+		{
+			precedence:       precedenceIndexer,
+			expectedPath:     filepath.Join(extractedPath, "example", "1.0.0"),
+			expectedShadowed: filepath.Join(zipPath, "example-1.0.0.zip"),
+		},
+		{
+			precedence:       precedencePath,
+			expectedPath:     filepath.Join(zipPath, "example-1.0.0.zip"),
+			expectedShadowed: filepath.Join(extractedPath, "example", "1.0.0"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.precedence, func(t *testing.T) {
+			indexer, err := newIndexer(&Config{
+				PackagePaths:      []string{zipPath, extractedPath},
+				PackagePrecedence: c.precedence,
+			})
+			require.NoError(t, err)
+			err = indexer.Init(context.Background())
+			require.NoError(t, err)
+
+			all, err := indexer.Get(context.Background(), nil)
+			require.NoError(t, err)
+			if assert.Len(t, all, 1) {
+				assert.Equal(t, c.expectedPath, all[0].BasePath)
+			}
+
+			opts := packages.NameVersionFilter("example", "1.0.0")
+			found, err := indexer.Get(context.Background(), &opts)
+			require.NoError(t, err)
+			if assert.Len(t, found, 1) {
+				assert.Equal(t, c.expectedPath, found[0].BasePath)
+			}
+
+			shadowed, err := indexer.Shadowed(context.Background())
+			require.NoError(t, err)
+			if assert.Len(t, shadowed, 1) {
+				assert.Equal(t, c.expectedShadowed, shadowed[0].BasePath)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := newIndexer(&Config{PackagePrecedence: "other"})
+		assert.Error(t, err)
+	})
+
+	t.Run("required signatures with upstreams", func(t *testing.T) {
+		config := Config{
+			PackagePrecedence: precedenceIndexer,
+			Upstreams:         []UpstreamConfig{{URL: "https://epr.elastic.co"}},
+		}
+		config.Signatures.Keyring = "./testdata/signatures/public-key.asc"
+		config.Signatures.RequireSignatures = true
+		_, err := newIndexer(&config)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
+)
+
+type InputType struct {
+	Type  string `yaml:"type" json:"type"`
+	Count int    `yaml:"count" json:"count"`
+}
+
+// inputsHandler lists the input types offered by packages, and how many packages offer each one.
+func inputsHandler(indexer Indexer, cache *responseCache, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := newInputsFilterFromQuery(r.URL.Query())
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		restrictFilter(r.Context(), filter)
+
+		response, ok := cache.getOrBuild(indexer, "inputs:"+filter.Key(), func() (*cachedResponse, bool) {
+			opts := packages.GetOptions{
+				Filter: filter,
+			}
+			packages, err := indexer.Get(r.Context(), &opts)
+			if err != nil {
+				notFoundError(w, err)
+				return nil, false
+			}
+
+			inputs := getInputs(r.Context(), packages)
+
+			data, err := getInputsOutput(r.Context(), inputs)
+			if err != nil {
+				notFoundError(w, err)
+				return nil, false
+			}
+			return &cachedResponse{json: newJSONResponse(data)}, true
+		})
+		if !ok {
+			return
+		}
+
+		cacheHeaders(w, cacheTime)
+		response.json.serve(w, r)
+	}
+}
+
+// newInputsFilterFromQuery builds the filter for the inputs endpoint, it supports the same
+// parameters as the categories endpoint, and filtering by category.
+func newInputsFilterFromQuery(query url.Values) (*packages.Filter, error) {
+	filter, err := newCategoriesFilterFromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := query.Get("category"); v != "" {
+		filter.Category = v
+	}
+
+	return filter, nil
+}
+
+func getInputs(ctx context.Context, packages packages.Packages) map[string]*InputType {
+	span, ctx := apm.StartSpan(ctx, "FilterInputs", "app")
+	defer span.End()
+
+	inputs := map[string]*InputType{}
+	for _, p := range packages {
+		for _, i := range p.InputTypes() {
+			if _, ok := inputs[i]; !ok {
+				inputs[i] = &InputType{Type: i}
+			}
+			inputs[i].Count++
+		}
+	}
+	return inputs
+}
+
+func getInputsOutput(ctx context.Context, inputs map[string]*InputType) ([]byte, error) {
+	span, ctx := apm.StartSpan(ctx, "GetInputsOutput", "app")
+	defer span.End()
+
+	var keys []string
+	for k := range inputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	outputInputs := []*InputType{}
+	for _, k := range keys {
+		outputInputs = append(outputInputs, inputs[k])
+	}
+
+	return util.MarshalJSONPretty(outputInputs)
+}
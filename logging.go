@@ -0,0 +1,308 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.elastic.co/apm"
+)
+
+// Formats of the logs.
+const (
+	// logFormatText writes logs as lines of text, with their fields at the end.
+	logFormatText = "text"
+
+	// logFormatJSON writes logs as JSON objects compatible with the Elastic Common Schema.
+	logFormatJSON = "json"
+)
+
+// ecsVersion is the version of the Elastic Common Schema followed by JSON logs.
+const ecsVersion = "1.6.0"
+
+// logLevel is the severity of a log entry, entries less severe than the configured level
+// are not logged.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+
+	// levelFatal is used for the errors that stop the registry, it cannot be configured.
+	levelFatal
+)
+
+var logLevels = map[string]logLevel{
+	"debug":   levelDebug,
+	"info":    levelInfo,
+	"warn":    levelWarn,
+	"warning": levelWarn,
+	"error":   levelError,
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	case levelFatal:
+		return "fatal"
+	default:
+		return "info"
+	}
+}
+
+// LogConfig is the configuration of the logs of the registry.
+type LogConfig struct {
+	// Minimum level of the logs, it can be `debug`, `info`, `warn` or `error`.
+	Level string `config:"level"`
+
+	// Format of the logs, it can be `text` or `json`, for JSON logs compatible with ECS.
+	Format string `config:"format"`
+}
+
+// logFields are the fields of a log entry, with their names in ECS.
+type logFields map[string]interface{}
+
+// logger writes structured logs.
+type logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+
+	// now returns the current time, used as timestamp of the log entries.
+	now func() time.Time
+}
+
+// defaultLogger is the logger used by the registry. Logs written with the standard log
+// package are also written with this logger once it is configured.
+var defaultLogger = &logger{out: os.Stderr, level: levelInfo, format: logFormatText, now: time.Now}
+
+// newLogger creates a logger that writes to the given writer.
+func newLogger(out io.Writer, config LogConfig) (*logger, error) {
+	l := logger{out: out, now: time.Now}
+	err := l.configure(config)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// configure sets the level and format of the logger.
+func (l *logger) configure(config LogConfig) error {
+	level := levelInfo
+	if config.Level != "" {
+		var found bool
+		level, found = logLevels[strings.ToLower(config.Level)]
+		if !found {
+			return errors.Errorf("unknown log level %q, expected debug, info, warn or error", config.Level)
+		}
+	}
+
+	format := config.Format
+	switch format {
+	case "":
+		format = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return errors.Errorf("unknown log format %q, expected %q or %q", config.Format, logFormatText, logFormatJSON)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+	l.format = format
+	return nil
+}
+
+// configureLogging configures the default logger, and makes it the destination of the logs
+// written with the standard log package.
+func configureLogging(config LogConfig) error {
+	err := defaultLogger.configure(config)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger: defaultLogger})
+	return nil
+}
+
+// loggingConfig returns the configuration of the logs, with the level and format given as
+// flags, if any, taking precedence over the ones in the configuration file.
+func loggingConfig(config *Config) LogConfig {
+	logConfig := config.Log
+	if logLevelFlag != "" {
+		logConfig.Level = logLevelFlag
+	}
+	if logFormatFlag != "" {
+		logConfig.Format = logFormatFlag
+	}
+	return logConfig
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// log writes a log entry with the given level, message and fields.
+func (l *logger) log(level logLevel, message string, fields logFields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	if l.format == logFormatJSON {
+		l.encodeJSON(&buf, level, message, fields)
+	} else {
+		l.encodeText(&buf, level, message, fields)
+	}
+	l.out.Write(buf.Bytes())
+}
+
+func (l *logger) encodeJSON(buf *bytes.Buffer, level logLevel, message string, fields logFields) {
+	entry := make(map[string]interface{}, len(fields)+5)
+	for name, value := range fields {
+		entry[name] = value
+	}
+	entry["@timestamp"] = l.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	entry["log.level"] = level.String()
+	entry["message"] = message
+	entry["ecs.version"] = ecsVersion
+	entry["service.name"] = serviceName
+
+	d, err := json.Marshal(entry)
+	if err != nil {
+		// Fields are built by the registry, this should not happen.
+		d, _ = json.Marshal(map[string]interface{}{
+			"@timestamp":  entry["@timestamp"],
+			"log.level":   levelError.String(),
+			"message":     fmt.Sprintf("encoding log entry failed: %v (message: %s)", err, message),
+			"ecs.version": ecsVersion,
+		})
+	}
+	buf.Write(d)
+	buf.WriteByte('\n')
+}
+
+func (l *logger) encodeText(buf *bytes.Buffer, level logLevel, message string, fields logFields) {
+	buf.WriteString(l.now().Format("2006/01/02 15:04:05 "))
+	if level != levelInfo {
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(message)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(buf, " %s=%v", name, fields[name])
+	}
+	buf.WriteByte('\n')
+}
+
+// stdLogWriter writes the logs of the standard log package with a logger. Messages starting
+// with "warning:", in any case, are logged with the warn level, and the rest with the info level.
+type stdLogWriter struct {
+	logger *logger
+}
+
+const warningPrefix = "warning:"
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := levelInfo
+	if len(message) >= len(warningPrefix) && strings.EqualFold(message[:len(warningPrefix)], warningPrefix) {
+		level = levelWarn
+		message = strings.TrimSpace(message[len(warningPrefix):])
+	}
+	w.logger.log(level, message, nil)
+	return len(p), nil
+}
+
+// fatal logs the message with the fatal level and exits, it replaces log.Fatal so the level
+// of these messages is kept.
+func fatal(v ...interface{}) {
+	defaultLogger.log(levelFatal, fmt.Sprint(v...), nil)
+	os.Exit(1)
+}
+
+// fatalf is the same as fatal, with a formatted message, it replaces log.Fatalf.
+func fatalf(format string, v ...interface{}) {
+	defaultLogger.log(levelFatal, fmt.Sprintf(format, v...), nil)
+	os.Exit(1)
+}
+
+// loggingMiddleware writes an access log entry for each request, once it is served.
+// Requests to the health endpoint are not logged.
+func loggingMiddleware(l *logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" || !l.enabled(levelInfo) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			logRequest(l, r, sw, time.Since(start))
+		})
+	}
+}
+
+// logRequest converts a served request into an access log entry.
+func logRequest(l *logger, r *http.Request, sw *statusResponseWriter, duration time.Duration) {
+	fields := logFields{
+		"event.dataset":             serviceName + ".access",
+		"event.duration":            duration.Nanoseconds(),
+		"http.request.method":       r.Method,
+		"http.response.status_code": sw.code,
+		"http.response.body.bytes":  sw.written,
+		"url.path":                  r.URL.Path,
+		"url.original":              r.RequestURI,
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		fields["source.ip"] = ip
+	}
+	if userAgent := r.UserAgent(); userAgent != "" {
+		fields["user_agent.original"] = userAgent
+	}
+	if route := routeTemplate(r); route != "" {
+		fields["labels.route"] = route
+	}
+	if tx := apm.TransactionFromContext(r.Context()); tx != nil {
+		traceContext := tx.TraceContext()
+		fields["trace.id"] = traceContext.Trace.String()
+		fields["transaction.id"] = traceContext.Span.String()
+	}
+
+	message := fmt.Sprintf("%s %s %d", r.Method, r.RequestURI, sw.code)
+	l.log(levelInfo, message, fields)
+}
@@ -0,0 +1,132 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmgorilla"
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LogConfig{Format: logFormatJSON})
+
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/package/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	router.HandleFunc("/health", healthHandler)
+	apmgorilla.Instrument(router, apmgorilla.WithTracer(tracer.Tracer))
+	router.Use(loggingMiddleware(logger))
+
+	req := httptest.NewRequest(http.MethodPost, "/package/example?force=true", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	entries := decodeLogEntries(t, &buf)
+	require.Len(t, entries, 1, "health checks should not be logged")
+	entry := entries[0]
+	assert.Equal(t, "2021-11-04T12:30:00.000Z", entry["@timestamp"])
+	assert.Equal(t, "info", entry["log.level"])
+	assert.Equal(t, ecsVersion, entry["ecs.version"])
+	assert.Equal(t, "POST /package/example?force=true 201", entry["message"])
+	assert.Equal(t, "POST", entry["http.request.method"])
+	assert.Equal(t, float64(http.StatusCreated), entry["http.response.status_code"])
+	assert.Equal(t, float64(len("created")), entry["http.response.body.bytes"])
+	assert.Equal(t, "/package/example", entry["url.path"])
+	assert.Equal(t, "/package/{name}", entry["labels.route"])
+	assert.Equal(t, "192.0.2.1", entry["source.ip"])
+	assert.Contains(t, entry, "event.duration")
+
+	tracer.Flush(nil)
+	var traceIDs []string
+	for _, tx := range tracer.Payloads().Transactions {
+		traceIDs = append(traceIDs, hex.EncodeToString(tx.TraceID[:]))
+	}
+	assert.Contains(t, traceIDs, entry["trace.id"])
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LogConfig{Level: "warn", Format: logFormatJSON})
+
+	w := stdLogWriter{logger: logger}
+	w.Write([]byte("Packages loaded.\n"))
+	w.Write([]byte("warning: unexpected file: foo, ignoring\n"))
+	w.Write([]byte("Warning: no packages found\n"))
+	logger.log(levelError, "serving failed", logFields{"url.path": "/search"})
+	logger.log(levelFatal, "listening failed", nil)
+
+	entries := decodeLogEntries(t, &buf)
+	require.Len(t, entries, 4)
+	assert.Equal(t, "warn", entries[0]["log.level"])
+	assert.Equal(t, "unexpected file: foo, ignoring", entries[0]["message"])
+	assert.Equal(t, "warn", entries[1]["log.level"])
+	assert.Equal(t, "no packages found", entries[1]["message"])
+	assert.Equal(t, "error", entries[2]["log.level"])
+	assert.Equal(t, "/search", entries[2]["url.path"])
+	assert.Equal(t, "fatal", entries[3]["log.level"])
+}
+
+func TestLoggerTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(t, &buf, LogConfig{})
+
+	logger.log(levelInfo, "GET /search 200", logFields{"url.path": "/search", "http.request.method": "GET"})
+	logger.log(levelDebug, "not logged", nil)
+	logger.log(levelWarn, "reload failed", nil)
+
+	expected := "2021/11/04 12:30:00 GET /search 200 http.request.method=GET url.path=/search\n" +
+		"2021/11/04 12:30:00 WARN reload failed\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestLoggerInvalidConfig(t *testing.T) {
+	_, err := newLogger(&bytes.Buffer{}, LogConfig{Level: "verbose"})
+	assert.Error(t, err)
+
+	_, err = newLogger(&bytes.Buffer{}, LogConfig{Format: "xml"})
+	assert.Error(t, err)
+}
+
+func newTestLogger(t *testing.T, buf *bytes.Buffer, config LogConfig) *logger {
+	logger, err := newLogger(buf, config)
+	require.NoError(t, err)
+	logger.now = func() time.Time {
+		return time.Date(2021, 11, 4, 12, 30, 0, 0, time.UTC)
+	}
+	return logger
+}
+
+func decodeLogEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		err := json.Unmarshal([]byte(line), &entry)
+		require.NoError(t, err, line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -17,8 +17,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"go.elastic.co/apm"
 	"go.elastic.co/apm/module/apmgorilla"
@@ -33,13 +38,26 @@ const (
 	version     = "1.5.2"
 )
 
+// Precedences of packages when the same version is available in multiple package paths or formats.
+const (
+	// Extracted packages take precedence over zipped packages, in any package path.
+	precedenceIndexer = "indexer"
+
+	// Packages in a package path take precedence over the ones in the following paths, in any format.
+	precedencePath = "path"
+)
+
 var (
 	address         string
 	httpProfAddress string
+	metricsAddress  string
 
 	tlsCertFile string
 	tlsKeyFile  string
 
+	logLevelFlag  string
+	logFormatFlag string
+
 	dryRun     bool
 	configPath string
 
@@ -48,6 +66,14 @@ var (
 		CacheTimeSearch:     10 * time.Minute,
 		CacheTimeCategories: 10 * time.Minute,
 		CacheTimeCatchAll:   10 * time.Minute,
+		WatchPollInterval:   10 * time.Second,
+		PackagePrecedence:   precedenceIndexer,
+		ResponseCacheSize:   64 * 1024 * 1024,
+		UploadMaxSize:       100 * 1024 * 1024,
+		Log: LogConfig{
+			Level:  "info",
+			Format: logFormatText,
+		},
 	}
 )
 
@@ -56,7 +82,10 @@ func init() {
 	flag.StringVar(&tlsCertFile, "tls-cert", "", "Path of the TLS certificate.")
 	flag.StringVar(&tlsKeyFile, "tls-key", "", "Path of the TLS key.")
 	flag.StringVar(&configPath, "config", "config.yml", "Path to the configuration file.")
+	flag.StringVar(&logLevelFlag, "log-level", "", "Minimum level of the logs (debug, info, warn or error), overrides log.level.")
+	flag.StringVar(&logFormatFlag, "log-format", "", "Format of the logs (text or json), overrides log.format.")
 	flag.StringVar(&httpProfAddress, "httpprof", "", "Enable HTTP profiler listening on the given address.")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "Serve metrics listening on the given address, instead of in the main address.")
 	// This flag is experimental and might be removed in the future or renamed
 	flag.BoolVar(&dryRun, "dry-run", false, "Runs a dry-run of the registry without starting the web service (experimental).")
 	flag.BoolVar(&packages.ValidationDisabled, "disable-package-validation", false, "Disable package content validation.")
@@ -68,30 +97,106 @@ type Config struct {
 	CacheTimeSearch     time.Duration `config:"cache_time.search"`
 	CacheTimeCategories time.Duration `config:"cache_time.categories"`
 	CacheTimeCatchAll   time.Duration `config:"cache_time.catch_all"`
+	WatchEnabled        bool          `config:"watch.enabled"`
+	WatchPollInterval   time.Duration `config:"watch.poll_interval"`
+	AdminToken          string        `config:"admin.token"`
+	PackagePrecedence   string        `config:"package_precedence"`
+	ResponseCacheSize   int64         `config:"response_cache.max_size"`
+	ArchiveCachePath    string        `config:"archive_cache.path"`
+	UploadPath          string        `config:"upload.path"`
+	UploadMaxSize       int64         `config:"upload.max_size"`
+
+	Log            LogConfig        `config:"log"`
+	TLS            TLSConfig        `config:"tls"`
+	Auth           AuthConfig       `config:"auth"`
+	Signatures     SignaturesConfig `config:"signatures"`
+	PackageBuckets []BucketConfig   `config:"package_buckets"`
+	Upstreams      []UpstreamConfig `config:"upstreams"`
+}
+
+// SignaturesConfig is the configuration for the verification of the signatures of packages.
+type SignaturesConfig struct {
+	// Path to the OpenPGP keyring with the public keys used to verify signatures. Signatures
+	// are not verified if it is not set.
+	Keyring string `config:"keyring"`
+
+	// If set, packages without a valid signature are not served.
+	RequireSignatures bool `config:"require_signatures"`
+
+	// Path to an OpenPGP private key used to sign local packages without signature. Signatures
+	// are built when requested for the first time.
+	PrivateKey           string `config:"private_key"`
+	PrivateKeyPassphrase string `config:"private_key_passphrase"`
+}
+
+// BucketConfig is the configuration of a bucket in an S3-compatible object storage with zipped packages.
+type BucketConfig struct {
+	Bucket string `config:"bucket" validate:"required"`
+	Prefix string `config:"prefix"`
+	Region string `config:"region"`
+
+	// Endpoint of the object storage service, to use services other than AWS S3.
+	Endpoint string `config:"endpoint"`
+
+	// Use path-style addressing for objects, usually needed with custom endpoints.
+	PathStyle bool `config:"path_style"`
+
+	// Static credentials, if not set, credentials are obtained from the environment.
+	AccessKeyID     string `config:"access_key_id"`
+	SecretAccessKey string `config:"secret_access_key"`
+}
+
+// UpstreamConfig is the configuration of another package registry whose packages are also served.
+type UpstreamConfig struct {
+	URL string `config:"url" validate:"required"`
+
+	// Path where artifacts downloaded from the upstream registry are stored. If not set,
+	// requests for artifacts are proxied to the upstream registry.
+	CachePath string `config:"cache_path"`
 }
 
 func main() {
 	parseFlags()
+	err := configureLogging(loggingConfig(&defaultConfig))
+	if err != nil {
+		fatal(err)
+	}
 	log.Println("Package registry started.")
 	defer log.Println("Package registry stopped.")
 
 	initHttpProf()
+	initMetricsServer()
 
-	server := initServer()
+	server, reindexer := initServer()
 	go func() {
 		err := runServer(server)
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error occurred while serving: %s", err)
+			fatalf("Error occurred while serving: %s", err)
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
-
-	ctx := context.TODO()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-reload:
+			log.Println("Reindex requested with SIGHUP.")
+			result, err := reindexer.reindex(context.Background())
+			if err != nil {
+				log.Printf("Reindex failed, previous packages and configuration are kept: %v", err)
+				continue
+			}
+			log.Printf("Reindex completed: %d packages added, %d removed, %d failed to load, %d shadowed.", result.Added, result.Removed, result.Failed, result.Shadowed)
+		case <-stop:
+			ctx := context.TODO()
+			if err := server.Shutdown(ctx); err != nil {
+				fatal(err)
+			}
+			return
+		}
 	}
 }
 
@@ -104,12 +209,12 @@ func initHttpProf() {
 	go func() {
 		err := http.ListenAndServe(httpProfAddress, nil)
 		if err != nil {
-			log.Fatalf("failed to start HTTP profiler: %v", err)
+			fatalf("failed to start HTTP profiler: %v", err)
 		}
 	}()
 }
 
-func initServer() *http.Server {
+func initServer() (*http.Server, *reindexer) {
 	apmTracer := initAPMTracer()
 	tx := apmTracer.StartTransaction("initServer", "backend.init")
 	defer tx.End()
@@ -117,11 +222,10 @@ func initServer() *http.Server {
 	ctx := apm.ContextWithTransaction(context.TODO(), tx)
 
 	config := mustLoadConfig()
-	packagesBasePaths := getPackagesBasePaths(config)
-	indexer := NewCombinedIndexer(
-		packages.NewFileSystemIndexer(packagesBasePaths...),
-		packages.NewZipFileSystemIndexer(packagesBasePaths...),
-	)
+	indexer, err := newIndexer(config)
+	if err != nil {
+		fatal(err)
+	}
 	ensurePackagesAvailable(ctx, indexer)
 
 	// If -dry-run=true is set, service stops here after validation
@@ -129,15 +233,183 @@ func initServer() *http.Server {
 		os.Exit(0)
 	}
 
-	router := mustLoadRouter(config, indexer)
-	apmgorilla.Instrument(router, apmgorilla.WithTracer(apmTracer))
+	reindexer := newReindexer(apmTracer)
+	err = reindexer.init(config, indexer)
+	if err != nil {
+		fatal(err)
+	}
+
+	tlsConfig, err := newServerTLSConfig(serverTLSConfig(config))
+	if err != nil {
+		fatal(err)
+	}
+
+	return &http.Server{Addr: address, Handler: reindexer, TLSConfig: tlsConfig}, reindexer
+}
+
+// serverTLSConfig returns the TLS configuration of the server, with the certificate and key
+// given as flags, if any, taking precedence over the ones in the configuration file.
+func serverTLSConfig(config *Config) TLSConfig {
+	tlsConfig := config.TLS
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		tlsConfig.Certificate = tlsCertFile
+		tlsConfig.Key = tlsKeyFile
+	}
+	return tlsConfig
+}
+
+func newIndexer(config *Config) (CombinedIndexer, error) {
+	packagesBasePaths := getPackagesBasePaths(config)
+
+	var archiveCache *packages.ArchiveCache
+	if config.ArchiveCachePath != "" {
+		var err error
+		archiveCache, err = packages.NewArchiveCache(config.ArchiveCachePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Upstreams) > 0 && config.Signatures.RequireSignatures {
+		// Packages from upstream registries are not verified, they would be served without signature.
+		return nil, errors.New("signatures.require_signatures cannot be used with upstreams, their packages are not verified")
+	}
+	verifier, err := newSignatureVerifier(config.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newPackageSigner(config.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	newFileSystemIndexer := func(paths ...string) *packages.FileSystemIndexer {
+		indexer := packages.NewFileSystemIndexer(paths...)
+		indexer.SetArchiveCache(archiveCache)
+		indexer.SetSignatureVerifier(verifier)
+		indexer.SetPackageSigner(signer)
+		return indexer
+	}
+	newZipFileSystemIndexer := func(paths ...string) *packages.FileSystemIndexer {
+		indexer := packages.NewZipFileSystemIndexer(paths...)
+		indexer.SetSignatureVerifier(verifier)
+		indexer.SetPackageSigner(signer)
+		return indexer
+	}
+	newTarGzFileSystemIndexer := func(paths ...string) *packages.FileSystemIndexer {
+		indexer := packages.NewTarGzFileSystemIndexer(paths...)
+		indexer.SetSignatureVerifier(verifier)
+		indexer.SetPackageSigner(signer)
+		return indexer
+	}
 
-	return &http.Server{Addr: address, Handler: router}
+	var indexers []Indexer
+	switch config.PackagePrecedence {
+	case precedenceIndexer:
+		indexers = append(indexers,
+			newFileSystemIndexer(packagesBasePaths...),
+			newZipFileSystemIndexer(packagesBasePaths...),
+			newTarGzFileSystemIndexer(packagesBasePaths...),
+		)
+	case precedencePath:
+		for _, path := range packagesBasePaths {
+			indexers = append(indexers,
+				newFileSystemIndexer(path),
+				newZipFileSystemIndexer(path),
+				newTarGzFileSystemIndexer(path),
+			)
+		}
+	default:
+		return nil, fmt.Errorf("unknown package precedence %q, expected %q or %q", config.PackagePrecedence, precedenceIndexer, precedencePath)
+	}
+	if config.UploadPath != "" {
+		indexer := packages.NewUploadIndexer(config.UploadPath)
+		indexer.SetSignatureVerifier(verifier)
+		indexer.SetPackageSigner(signer)
+		indexers = append(indexers, indexer)
+	}
+	for _, bucket := range config.PackageBuckets {
+		client, err := newS3Client(bucket)
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating client for bucket failed (bucket: %s)", bucket.Bucket)
+		}
+		indexer := packages.NewS3Indexer(client, bucket.Bucket, bucket.Prefix)
+		indexer.SetSignatureVerifier(verifier)
+		indexers = append(indexers, indexer)
+	}
+	for _, upstream := range config.Upstreams {
+		indexers = append(indexers, packages.NewUpstreamIndexer(upstream.URL, upstream.CachePath))
+	}
+	return NewCombinedIndexer(indexers...), nil
+}
+
+// newSignatureVerifier creates the verifier for the signatures of packages, it returns nil if
+// signatures don't need to be verified.
+func newSignatureVerifier(config SignaturesConfig) (*packages.SignatureVerifier, error) {
+	if config.Keyring == "" {
+		if config.RequireSignatures {
+			return nil, errors.New("signatures.require_signatures requires signatures.keyring")
+		}
+		return nil, nil
+	}
+	verifier, err := packages.NewSignatureVerifierFromFile(config.Keyring, config.RequireSignatures)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading signatures keyring failed (path: %s)", config.Keyring)
+	}
+	return verifier, nil
+}
+
+// newPackageSigner creates the signer for local packages without signature, it returns nil if
+// packages don't need to be signed.
+func newPackageSigner(config SignaturesConfig) (*packages.PackageSigner, error) {
+	if config.PrivateKey == "" {
+		return nil, nil
+	}
+	signer, err := packages.NewPackageSignerFromFile(config.PrivateKey, config.PrivateKeyPassphrase)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading signatures private key failed (path: %s)", config.PrivateKey)
+	}
+	return signer, nil
+}
+
+// newPublicKeys returns a verifier with the public keys that clients can use to verify the
+// signatures served by the registry. It returns nil if signatures are not configured.
+func newPublicKeys(config SignaturesConfig) (*packages.SignatureVerifier, error) {
+	verifier, err := newSignatureVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newPackageSigner(config)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		verifier = verifier.WithSigner(signer)
+	}
+	return verifier, nil
+}
+
+func newS3Client(config BucketConfig) (*s3.S3, error) {
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(config.PathStyle)
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+	if config.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+	if config.AccessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKeyID, config.SecretAccessKey, ""))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
 }
 
 func runServer(server *http.Server) error {
-	if tlsCertFile != "" && tlsKeyFile != "" {
-		return server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	if server.TLSConfig != nil {
+		// Certificates are provided by the TLS configuration.
+		return server.ListenAndServeTLS("", "")
 	}
 	return server.ListenAndServe()
 }
@@ -154,7 +426,7 @@ func initAPMTracer() *apm.Tracer {
 		ServiceVersion: version,
 	})
 	if err != nil {
-		log.Fatalf("Failed to initialize APM agent: %v", err)
+		fatalf("Failed to initialize APM agent: %v", err)
 	}
 	return tracer
 }
@@ -162,7 +434,11 @@ func initAPMTracer() *apm.Tracer {
 func mustLoadConfig() *Config {
 	config, err := getConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	err = configureLogging(loggingConfig(config))
+	if err != nil {
+		fatal(err)
 	}
 	printConfig(config)
 	return config
@@ -194,45 +470,89 @@ func getPackagesBasePaths(config *Config) []string {
 
 func printConfig(config *Config) {
 	log.Printf("Packages paths: %s\n", strings.Join(config.PackagePaths, ", "))
+	log.Printf("Packages precedence: %s\n", config.PackagePrecedence)
+	if tlsConfig := serverTLSConfig(config); tlsConfig.enabled() {
+		log.Printf("TLS certificate: %s\n", tlsConfig.Certificate)
+		if tlsConfig.ClientCA != "" {
+			log.Printf("TLS client CA: %s (client authentication: %s)\n", tlsConfig.ClientCA, tlsConfig.clientAuthMode())
+		}
+	}
+	if config.ArchiveCachePath != "" {
+		log.Printf("Archives cache path: %s\n", config.ArchiveCachePath)
+	}
+	if config.UploadPath != "" {
+		log.Printf("Uploads path: %s (max size: %d bytes)\n", config.UploadPath, config.UploadMaxSize)
+		if config.AdminToken == "" && len(config.Auth.Tokens) == 0 && len(config.Auth.HMACSecrets) == 0 {
+			log.Println("warning: uploads are disabled, tokens are required to publish packages")
+		}
+	}
+	if config.Signatures.Keyring != "" {
+		log.Printf("Signatures keyring: %s (required: %t)\n", config.Signatures.Keyring, config.Signatures.RequireSignatures)
+	}
+	if config.Signatures.PrivateKey != "" {
+		log.Printf("Signatures private key: %s\n", config.Signatures.PrivateKey)
+	}
+	for _, bucket := range config.PackageBuckets {
+		log.Printf("Packages bucket: s3://%s/%s\n", bucket.Bucket, bucket.Prefix)
+	}
+	for _, upstream := range config.Upstreams {
+		log.Printf("Upstream registry: %s\n", upstream.URL)
+	}
 	log.Println("Cache time for /search: ", config.CacheTimeSearch)
 	log.Println("Cache time for /categories: ", config.CacheTimeCategories)
 	log.Println("Cache time for all others: ", config.CacheTimeCatchAll)
+	if config.ResponseCacheSize > 0 {
+		log.Printf("Response cache size: %d bytes\n", config.ResponseCacheSize)
+	}
+	if config.AdminToken != "" || len(config.Auth.Tokens) > 0 || len(config.Auth.HMACSecrets) > 0 {
+		log.Printf("Admin endpoints enabled, %d static tokens and %d HMAC secrets configured.\n", len(config.Auth.Tokens), len(config.Auth.HMACSecrets))
+	}
+	if config.Auth.Anonymous.Disabled {
+		log.Println("Anonymous requests disabled.")
+	} else if config.Auth.Anonymous.HideInternal {
+		log.Println("Internal packages hidden to anonymous requests.")
+	}
+	if config.WatchEnabled {
+		log.Println("Watching packages paths for changes, poll interval if notifications are not available: ", config.WatchPollInterval)
+	}
 }
 
 func ensurePackagesAvailable(ctx context.Context, indexer Indexer) {
 	err := indexer.Init(ctx)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	packages, err := indexer.Get(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	if len(packages) == 0 {
-		log.Fatal("No packages available")
+		fatal("No packages available")
 	}
 
 	log.Printf("%v package manifests loaded.\n", len(packages))
 }
 
-func mustLoadRouter(config *Config, indexer Indexer) *mux.Router {
-	router, err := getRouter(config, indexer)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return router
-}
-
-func getRouter(config *Config, indexer Indexer) (*mux.Router, error) {
+func getRouter(config *Config, indexer Indexer, reindexer *reindexer) (*mux.Router, error) {
 	artifactsHandler := artifactsHandler(indexer, config.CacheTimeCatchAll)
+	tarGzArtifactsHandler := tarGzArtifactsHandler(indexer, config.CacheTimeCatchAll)
+	checksumsHandler := checksumsHandler(indexer, config.CacheTimeCatchAll)
 	signaturesHandler := signaturesHandler(indexer, config.CacheTimeCatchAll)
 	faviconHandleFunc, err := faviconHandler(config.CacheTimeCatchAll)
 	if err != nil {
 		return nil, err
 	}
-	indexHandlerFunc, err := indexHandler(config.CacheTimeIndex)
+	authenticator, err := newAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	publicKeys, err := newPublicKeys(config.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	indexHandlerFunc, err := indexHandler(config.CacheTimeIndex, publicKeys != nil)
 	if err != nil {
 		return nil, err
 	}
@@ -240,40 +560,62 @@ func getRouter(config *Config, indexer Indexer) (*mux.Router, error) {
 	packageIndexHandler := packageIndexHandler(indexer, config.CacheTimeCatchAll)
 	staticHandler := staticHandler(indexer, config.CacheTimeCatchAll)
 
+	cache := newResponseCache(config.ResponseCacheSize)
+
 	router := mux.NewRouter().StrictSlash(true)
+	router.NotFoundHandler = http.Handler(notFoundHandler(fmt.Errorf("404 page not found")))
+	if reindexer != nil {
+		// Instrumented before adding other middlewares, so they can see the APM transaction.
+		apmgorilla.Instrument(router, apmgorilla.WithTracer(reindexer.tracer))
+	}
 
 	router.HandleFunc("/", indexHandlerFunc)
 	router.HandleFunc("/index.json", indexHandlerFunc)
-	router.HandleFunc("/search", searchHandler(indexer, config.CacheTimeSearch))
-	router.HandleFunc("/categories", categoriesHandler(indexer, config.CacheTimeCategories))
+	router.HandleFunc("/search", searchHandler(indexer, cache, config.CacheTimeSearch))
+	router.HandleFunc("/categories", categoriesHandler(indexer, cache, config.CacheTimeCategories))
+	router.HandleFunc("/inputs", inputsHandler(indexer, cache, config.CacheTimeCatchAll))
 	router.HandleFunc("/health", healthHandler)
 	router.HandleFunc("/favicon.ico", faviconHandleFunc)
+	if publisher := findPublisher(indexer); publisher != nil && authenticator.hasTokens() {
+		// Registered before the artifacts handler, so uploads to the path of the artifact are handled here.
+		uploadHandler := requireScope(scopeWrite, uploadHandler(indexer, publisher, config.UploadMaxSize))
+		router.HandleFunc(uploadRouterPath, uploadHandler).Methods(http.MethodPost)
+		router.HandleFunc(artifactsRouterPath, uploadHandler).Methods(http.MethodPut)
+	}
 	router.HandleFunc(artifactsRouterPath, artifactsHandler)
+	router.HandleFunc(tarGzArtifactsRouterPath, tarGzArtifactsHandler)
+	router.HandleFunc(checksumsRouterPath, checksumsHandler)
 	router.HandleFunc(signaturesRouterPath, signaturesHandler)
+	if publicKeys != nil {
+		publicKeyHandler, err := publicKeyHandler(publicKeys, config.CacheTimeCatchAll)
+		if err != nil {
+			return nil, err
+		}
+		publicKeyInfoHandler, err := publicKeyInfoHandler(publicKeys, config.CacheTimeCatchAll)
+		if err != nil {
+			return nil, err
+		}
+		router.HandleFunc(publicKeyRouterPath, publicKeyHandler)
+		router.HandleFunc(publicKeyInfoRouterPath, publicKeyInfoHandler)
+	}
 	router.HandleFunc(packageIndexRouterPath, packageIndexHandler)
 	router.HandleFunc(staticRouterPath, staticHandler)
-	router.Use(loggingMiddleware)
-	router.NotFoundHandler = http.Handler(notFoundHandler(fmt.Errorf("404 page not found")))
+	if reindexer != nil && authenticator.hasTokens() {
+		router.HandleFunc(reindexRouterPath, requireScope(scopeWrite, reindexHandler(reindexer))).Methods(http.MethodPost)
+	}
+	if authenticator.hasTokens() {
+		router.HandleFunc(cacheStatsRouterPath, requireScope(scopeWrite, cacheStatsHandler(cache))).Methods(http.MethodGet)
+	}
+	if metricsAddress == "" && authenticator.hasTokens() {
+		router.HandleFunc(metricsRouterPath, requireScope(scopeWrite, promhttp.Handler().ServeHTTP)).Methods(http.MethodGet)
+	}
+	router.Use(loggingMiddleware(defaultLogger))
+	router.Use(metricsMiddleware)
+	router.Use(authMiddleware(authenticator))
+	router.Use(compressionMiddleware)
 	return router, nil
 }
 
 // healthHandler is used for Docker/K8s deployments. It returns 200 if the service is live
 // In addition ?ready=true can be used for a ready request. Currently both are identical.
 func healthHandler(w http.ResponseWriter, r *http.Request) {}
-
-// logging middle to log all requests
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logRequest(r)
-		next.ServeHTTP(w, r)
-	})
-}
-
-// logRequest converts a request object into a proper logging event
-func logRequest(r *http.Request) {
-	// Do not log requests to the health endpoint
-	if r.RequestURI == "/health" {
-		return
-	}
-	log.Println(fmt.Sprintf("source.ip: %s, url.original: %s", r.RemoteAddr, r.RequestURI))
-}
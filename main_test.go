@@ -5,8 +5,10 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
@@ -45,7 +47,7 @@ func TestEndpoints(t *testing.T) {
 	faviconHandleFunc, err := faviconHandler(testCacheTime)
 	require.NoError(t, err)
 
-	indexHandleFunc, err := indexHandler(testCacheTime)
+	indexHandleFunc, err := indexHandler(testCacheTime, false)
 	require.NoError(t, err)
 
 	tests := []struct {
@@ -56,27 +58,51 @@ func TestEndpoints(t *testing.T) {
 	}{
 		{"/", "", "index.json", indexHandleFunc},
 		{"/index.json", "", "index.json", indexHandleFunc},
-		{"/search", "/search", "search.json", searchHandler(indexer, testCacheTime)},
-		{"/search?all=true", "/search", "search-all.json", searchHandler(indexer, testCacheTime)},
-		{"/categories", "/categories", "categories.json", categoriesHandler(indexer, testCacheTime)},
-		{"/categories?experimental=true", "/categories", "categories-experimental.json", categoriesHandler(indexer, testCacheTime)},
-		{"/categories?experimental=foo", "/categories", "categories-experimental-error.json", categoriesHandler(indexer, testCacheTime)},
-		{"/categories?experimental=true&kibana.version=6.5.2", "/categories", "categories-kibana652.json", categoriesHandler(indexer, testCacheTime)},
-		{"/categories?include_policy_templates=true", "/categories", "categories-include-policy-templates.json", categoriesHandler(indexer, testCacheTime)},
-		{"/categories?include_policy_templates=foo", "/categories", "categories-include-policy-templates-error.json", categoriesHandler(indexer, testCacheTime)},
-		{"/search?kibana.version=6.5.2", "/search", "search-kibana652.json", searchHandler(indexer, testCacheTime)},
-		{"/search?kibana.version=7.2.1", "/search", "search-kibana721.json", searchHandler(indexer, testCacheTime)},
-		{"/search?kibana.version=8.0.0", "/search", "search-kibana800.json", searchHandler(indexer, testCacheTime)},
-		{"/search?category=web", "/search", "search-category-web.json", searchHandler(indexer, testCacheTime)},
-		{"/search?category=web&all=true", "/search", "search-category-web-all.json", searchHandler(indexer, testCacheTime)},
-		{"/search?category=custom", "/search", "search-category-custom.json", searchHandler(indexer, testCacheTime)},
-		{"/search?package=example", "/search", "search-package-example.json", searchHandler(indexer, testCacheTime)},
-		{"/search?package=example&all=true", "/search", "search-package-example-all.json", searchHandler(indexer, testCacheTime)},
-		{"/search?internal=true", "/search", "search-package-internal.json", searchHandler(indexer, testCacheTime)},
-		{"/search?internal=bar", "/search", "search-package-internal-error.json", searchHandler(indexer, testCacheTime)},
-		{"/search?experimental=true", "/search", "search-package-experimental.json", searchHandler(indexer, testCacheTime)},
-		{"/search?experimental=foo", "/search", "search-package-experimental-error.json", searchHandler(indexer, testCacheTime)},
-		{"/search?category=datastore&experimental=true", "/search", "search-category-datastore.json", searchHandler(indexer, testCacheTime)},
+		{"/search", "/search", "search.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?all=true", "/search", "search-all.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/categories", "/categories", "categories.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?experimental=true", "/categories", "categories-experimental.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?experimental=foo", "/categories", "categories-experimental-error.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?experimental=true&kibana.version=6.5.2", "/categories", "categories-kibana652.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?type=solution&release=experimental", "/categories", "categories-type-solution.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?release=ga", "/categories", "categories-release-ga.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?owner=ruflin", "/categories", "categories-owner.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?input=logs", "/categories", "categories-input-logs.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/inputs", "/inputs", "inputs.json", inputsHandler(indexer, nil, testCacheTime)},
+		{"/inputs?experimental=true", "/inputs", "inputs-experimental.json", inputsHandler(indexer, nil, testCacheTime)},
+		{"/inputs?data_stream.type=metrics", "/inputs", "inputs-data-stream-type-metrics.json", inputsHandler(indexer, nil, testCacheTime)},
+		{"/inputs?category=custom", "/inputs", "inputs-category-custom.json", inputsHandler(indexer, nil, testCacheTime)},
+		{"/inputs?release=foo", "/inputs", "inputs-release-error.json", inputsHandler(indexer, nil, testCacheTime)},
+		{"/categories?include_policy_templates=true", "/categories", "categories-include-policy-templates.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/categories?include_policy_templates=foo", "/categories", "categories-include-policy-templates-error.json", categoriesHandler(indexer, nil, testCacheTime)},
+		{"/search?kibana.version=6.5.2", "/search", "search-kibana652.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?kibana.version=7.2.1", "/search", "search-kibana721.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?kibana.version=8.0.0", "/search", "search-kibana800.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?category=web", "/search", "search-category-web.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?category=web&all=true", "/search", "search-category-web-all.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?category=custom", "/search", "search-category-custom.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?package=example", "/search", "search-package-example.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?package=example&all=true", "/search", "search-package-example-all.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?internal=true", "/search", "search-package-internal.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?internal=bar", "/search", "search-package-internal-error.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?experimental=true", "/search", "search-package-experimental.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?experimental=foo", "/search", "search-package-experimental-error.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?category=datastore&experimental=true", "/search", "search-category-datastore.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?q=example", "/search", "search-query-example.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?q=Multi+vers&all=true", "/search", "search-query-multiversion-all.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?q=nonexistent", "/search", "search-query-no-results.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?all=true&sort=-version&per_page=5", "/search", "search-sort-version-page-1.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?all=true&sort=-version&page=2&per_page=5", "/search", "search-sort-version-page-2.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?sort=release", "/search", "search-sort-release.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?sort=size", "/search", "search-sort-error.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?page=0", "/search", "search-page-error.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?type=solution", "/search", "search-type-solution.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?release=beta", "/search", "search-release-beta.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?release=experimental", "/search", "search-release-experimental.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?release=foo", "/search", "search-release-error.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?owner=ruflin", "/search", "search-owner.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?data_stream.type=metrics", "/search", "search-data-stream-type-metrics.json", searchHandler(indexer, nil, testCacheTime)},
+		{"/search?input=logs", "/search", "search-input-logs.json", searchHandler(indexer, nil, testCacheTime)},
 		{"/favicon.ico", "", "favicon.ico", faviconHandleFunc},
 	}
 
@@ -95,6 +121,7 @@ func TestArtifacts(t *testing.T) {
 	require.NoError(t, err)
 
 	artifactsHandler := artifactsHandler(indexer, testCacheTime)
+	tarGzArtifactsHandler := tarGzArtifactsHandler(indexer, testCacheTime)
 
 	tests := []struct {
 		endpoint string
@@ -106,6 +133,10 @@ func TestArtifacts(t *testing.T) {
 		{"/epr/example/example-999.0.2.zip", artifactsRouterPath, "artifact-package-version-not-found.txt", artifactsHandler},
 		{"/epr/example/missing-0.1.2.zip", artifactsRouterPath, "artifact-package-not-found.txt", artifactsHandler},
 		{"/epr/example/example-a.b.c.zip", artifactsRouterPath, "artifact-package-invalid-version.txt", artifactsHandler},
+		{"/epr/example/example-0.0.2.tar.gz", tarGzArtifactsRouterPath, "example-0.0.2.tar.gz-preview.txt", tarGzArtifactsHandler},
+		{"/epr/example/example-0.0.2.zip.sha256", checksumsRouterPath, "example-0.0.2.zip.sha256", checksumsHandler(indexer, testCacheTime)},
+		{"/epr/example/example-999.0.2.zip.sha256", checksumsRouterPath, "artifact-package-version-not-found.txt", checksumsHandler(indexer, testCacheTime)},
+		{"/epr/example/example-999.0.2.tar.gz", tarGzArtifactsRouterPath, "artifact-package-version-not-found.txt", tarGzArtifactsHandler},
 	}
 
 	for _, test := range tests {
@@ -228,6 +259,34 @@ func TestStaticsModifiedTime(t *testing.T) {
 			},
 			code: 200,
 		},
+
+		// Archived on the fly
+		{
+			title:    "Cached entry archived on the fly",
+			endpoint: "/epr/example/example-0.0.2.tar.gz",
+			headers: map[string]string{
+				// Assuming that the file hasn't been modified in the future.
+				ifModifiedSinceHeader: time.Now().UTC().Format(http.TimeFormat),
+			},
+			code: 304,
+		},
+		{
+			title:    "Old cached entry archived on the fly",
+			endpoint: "/epr/example/example-0.0.2.zip",
+			headers: map[string]string{
+				ifModifiedSinceHeader: time.Time{}.Format(http.TimeFormat),
+			},
+			code: 200,
+		},
+		{
+			title:    "Cached entry converted on the fly",
+			endpoint: "/epr/example/example-1.0.1.tar.gz",
+			headers: map[string]string{
+				// Assuming that the file hasn't been modified in the future.
+				ifModifiedSinceHeader: time.Now().UTC().Format(http.TimeFormat),
+			},
+			code: 304,
+		},
 	}
 
 	indexer := NewCombinedIndexer(
@@ -239,6 +298,8 @@ func TestStaticsModifiedTime(t *testing.T) {
 
 	router := mux.NewRouter()
 	router.HandleFunc(staticRouterPath, staticHandler(indexer, testCacheTime))
+	router.HandleFunc(artifactsRouterPath, artifactsHandler(indexer, testCacheTime))
+	router.HandleFunc(tarGzArtifactsRouterPath, tarGzArtifactsHandler(indexer, testCacheTime))
 
 	for _, test := range tests {
 		t.Run(test.title, func(t *testing.T) {
@@ -260,6 +321,42 @@ func TestStaticsModifiedTime(t *testing.T) {
 	}
 }
 
+func TestSignaturesPublicKey(t *testing.T) {
+	verifier, err := packages.NewSignatureVerifierFromFile("./testdata/signatures/public-key.asc", false)
+	require.NoError(t, err)
+
+	indexHandleFunc, err := indexHandler(testCacheTime, true)
+	require.NoError(t, err)
+	publicKeyHandler, err := publicKeyHandler(verifier, testCacheTime)
+	require.NoError(t, err)
+	publicKeyInfoHandler, err := publicKeyInfoHandler(verifier, testCacheTime)
+	require.NoError(t, err)
+
+	tests := []struct {
+		endpoint string
+		path     string
+		file     string
+		handler  func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"/", "", "index-signatures.json", indexHandleFunc},
+		{"/signatures/public-key.asc", publicKeyRouterPath, "signatures-public-key.asc", publicKeyHandler},
+		{"/signatures/public-key.json", publicKeyInfoRouterPath, "signatures-public-key.json", publicKeyInfoHandler},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			runEndpoint(t, test.endpoint, test.path, test.file, test.handler)
+		})
+	}
+
+	// Served keys can be used to verify signatures.
+	recorder := httptest.NewRecorder()
+	publicKeyHandler(recorder, httptest.NewRequest(http.MethodGet, publicKeyRouterPath, nil))
+	served, err := packages.NewSignatureVerifier(recorder.Body, false)
+	require.NoError(t, err)
+	assert.Equal(t, verifier.PublicKeys(), served.PublicKeys())
+}
+
 func TestZippedArtifacts(t *testing.T) {
 	indexer := packages.NewZipFileSystemIndexer("./testdata/local-storage")
 
@@ -267,6 +364,7 @@ func TestZippedArtifacts(t *testing.T) {
 	require.NoError(t, err)
 
 	artifactsHandler := artifactsHandler(indexer, testCacheTime)
+	tarGzArtifactsHandler := tarGzArtifactsHandler(indexer, testCacheTime)
 
 	staticHandler := staticHandler(indexer, testCacheTime)
 
@@ -277,6 +375,8 @@ func TestZippedArtifacts(t *testing.T) {
 		handler  func(w http.ResponseWriter, r *http.Request)
 	}{
 		{"/epr/example/example-1.0.1.zip", artifactsRouterPath, "example-1.0.1.zip-preview.txt", artifactsHandler},
+		{"/epr/example/example-1.0.1.tar.gz", tarGzArtifactsRouterPath, "example-1.0.1-converted.tar.gz-preview.txt", tarGzArtifactsHandler},
+		{"/epr/example/example-1.0.1.zip.sha256", checksumsRouterPath, "example-1.0.1.zip.sha256", checksumsHandler(indexer, testCacheTime)},
 		{"/epr/example/example-999.0.2.zip", artifactsRouterPath, "artifact-package-version-not-found.txt", artifactsHandler},
 		{"/package/example/1.0.1/docs/README.md", staticRouterPath, "example-1.0.1-README.md", staticHandler},
 		{"/package/example/1.0.1/img/kibana-envoyproxy.jpg", staticRouterPath, "example-1.0.1-screenshot.jpg", staticHandler},
@@ -289,6 +389,37 @@ func TestZippedArtifacts(t *testing.T) {
 	}
 }
 
+func TestTarGzArtifacts(t *testing.T) {
+	indexer := packages.NewTarGzFileSystemIndexer("./testdata/tar-storage")
+
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	artifactsHandler := artifactsHandler(indexer, testCacheTime)
+	tarGzArtifactsHandler := tarGzArtifactsHandler(indexer, testCacheTime)
+
+	staticHandler := staticHandler(indexer, testCacheTime)
+
+	tests := []struct {
+		endpoint string
+		path     string
+		file     string
+		handler  func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"/epr/example/example-1.0.1.tar.gz", tarGzArtifactsRouterPath, "example-1.0.1.tar.gz-preview.txt", tarGzArtifactsHandler},
+		{"/epr/example/example-1.0.1.zip", artifactsRouterPath, "example-1.0.1-converted.zip-preview.txt", artifactsHandler},
+		{"/epr/example/example-999.0.2.tar.gz", tarGzArtifactsRouterPath, "artifact-package-version-not-found.txt", tarGzArtifactsHandler},
+		{"/package/example/1.0.1/docs/README.md", staticRouterPath, "example-1.0.1-README.md", staticHandler},
+		{"/package/example/1.0.1/img/kibana-envoyproxy.jpg", staticRouterPath, "example-1.0.1-screenshot.jpg", staticHandler},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			runEndpoint(t, test.endpoint, test.path, test.file, test.handler)
+		})
+	}
+}
+
 func TestPackageIndex(t *testing.T) {
 	indexer := NewCombinedIndexer(
 		packages.NewFileSystemIndexer("./testdata/package"),
@@ -433,7 +564,7 @@ func TestContentTypes(t *testing.T) {
 }
 
 // TestRangeDownloads tests that range downloads continue working for packages stored
-// on different file systems.
+// on different file systems, also when they are archived on the fly without archive cache.
 func TestRangeDownloads(t *testing.T) {
 	indexer := NewCombinedIndexer(
 		packages.NewFileSystemIndexer("./testdata/package"),
@@ -446,17 +577,20 @@ func TestRangeDownloads(t *testing.T) {
 	router := mux.NewRouter()
 	router.HandleFunc(staticRouterPath, staticHandler(indexer, testCacheTime))
 	router.HandleFunc(artifactsRouterPath, artifactsHandler(indexer, testCacheTime))
+	router.HandleFunc(tarGzArtifactsRouterPath, tarGzArtifactsHandler(indexer, testCacheTime))
 
 	tests := []struct {
 		endpoint  string
 		supported bool
 		file      string
 	}{
-		{"/epr/example/example-0.0.2.zip", false, "example-0.0.2.zip-preview.txt"},
+		{"/epr/example/example-0.0.2.zip", true, "example-0.0.2.zip-preview.txt"},
+		{"/epr/example/example-0.0.2.tar.gz", true, "example-0.0.2.tar.gz-preview.txt"},
 		{"/package/example/1.0.0/img/kibana-envoyproxy.jpg", true, "example-1.0.0-screenshot.jpg"},
 
 		// zip
 		{"/epr/example/example-1.0.1.zip", true, "example-1.0.1.zip-preview.txt"},
+		{"/epr/example/example-1.0.1.tar.gz", true, "example-1.0.1-converted.tar.gz-preview.txt"},
 		{"/package/example/1.0.1/img/kibana-envoyproxy.jpg", true, "example-1.0.1-screenshot.jpg"},
 	}
 
@@ -472,21 +606,28 @@ func TestRangeDownloads(t *testing.T) {
 }
 
 func runEndpoint(t *testing.T, endpoint, path, file string, handler func(w http.ResponseWriter, r *http.Request)) {
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	recorder := httptest.NewRecorder()
 	router := mux.NewRouter()
 	if path == "" {
 		router.PathPrefix("/").HandlerFunc(handler)
 	} else {
 		router.HandleFunc(path, handler)
 	}
-	req.RequestURI = endpoint
-	router.ServeHTTP(recorder, req)
+	serve := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
 
+		recorder := httptest.NewRecorder()
+		req.RequestURI = endpoint
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := serve("")
 	assertExpectedBody(t, recorder.Body, file)
 
 	// Skip cache check if 4xx error
@@ -494,6 +635,21 @@ func runEndpoint(t *testing.T, endpoint, path, file string, handler func(w http.
 		cacheTime := fmt.Sprintf("%.0f", testCacheTime.Seconds())
 		assert.Equal(t, recorder.Header()["Cache-Control"], []string{"max-age=" + cacheTime, "public"})
 	}
+
+	// JSON responses can be revalidated with their ETag.
+	if recorder.Code == http.StatusOK && recorder.Header().Get("Content-Type") == "application/json" {
+		etag := recorder.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		notModified := serve(etag)
+		assert.Equal(t, http.StatusNotModified, notModified.Code)
+		assert.Equal(t, etag, notModified.Header().Get("ETag"))
+		assert.Empty(t, notModified.Body.String())
+
+		modified := serve(`"other", W/"other"`)
+		assert.Equal(t, http.StatusOK, modified.Code)
+		assert.Equal(t, recorder.Body.String(), modified.Body.String())
+	}
 }
 
 type recordedBody interface {
@@ -507,7 +663,7 @@ func assertExpectedBody(t *testing.T, body recordedBody, expectedFile string) {
 
 	recorded := body.Bytes()
 	if strings.HasSuffix(expectedFile, "-preview.txt") {
-		recorded = listArchivedFiles(t, recorded)
+		recorded = listArchivedFiles(t, recorded, strings.HasSuffix(expectedFile, ".tar.gz-preview.txt"))
 	}
 
 	if *generateFlag {
@@ -525,7 +681,11 @@ func assertExpectedBody(t *testing.T, body recordedBody, expectedFile string) {
 	assert.Equal(t, string(bytes.TrimSpace(data)), string(bytes.TrimSpace(recorded)))
 }
 
-func listArchivedFiles(t *testing.T, body []byte) []byte {
+func listArchivedFiles(t *testing.T, body []byte, tarGz bool) []byte {
+	if tarGz {
+		return listTarGzFiles(t, body)
+	}
+
 	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
 	require.NoError(t, err)
 
@@ -538,6 +698,23 @@ func listArchivedFiles(t *testing.T, body []byte) []byte {
 	return listing.Bytes()
 }
 
+func listTarGzFiles(t *testing.T, body []byte) []byte {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+
+	var listing bytes.Buffer
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		listing.WriteString(fmt.Sprintf("%d %s\n", header.Size, header.Name))
+	}
+	return listing.Bytes()
+}
+
 func downloadWithRanges(t *testing.T, handler http.Handler, endpoint string) (bytes.Buffer, bool) {
 	var buf bytes.Buffer
 
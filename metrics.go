@@ -0,0 +1,65 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/elastic/package-registry/metrics"
+	"github.com/elastic/package-registry/packages"
+)
+
+const metricsRouterPath = "/metrics"
+
+// initMetricsServer starts a server for the metrics endpoint if a separate address is
+// configured for it, otherwise the endpoint is served by the main server.
+func initMetricsServer() {
+	if metricsAddress == "" {
+		return
+	}
+
+	router := http.NewServeMux()
+	router.Handle(metricsRouterPath, promhttp.Handler())
+
+	log.Printf("Starting metrics server in %s", metricsAddress)
+	go func() {
+		err := http.ListenAndServe(metricsAddress, router)
+		if err != nil {
+			fatalf("failed to start metrics server: %v", err)
+		}
+	}()
+}
+
+// metricsMiddleware records the metrics of the requests handled by the router, labeled by
+// the template of the route they match.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		path := routeTemplate(r)
+		metrics.HTTPRequests.WithLabelValues(r.Method, path, strconv.Itoa(sw.code)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, path).Observe(time.Since(start).Seconds())
+		metrics.HTTPResponseBytes.WithLabelValues(path).Add(float64(sw.written))
+	})
+}
+
+// countDownloads counts the downloads of packages served with the given function. Only
+// complete responses are counted, not the ones for conditional, partial or failed requests.
+func countDownloads(format string, serve func(http.ResponseWriter, *http.Request, *packages.Package)) func(http.ResponseWriter, *http.Request, *packages.Package) {
+	return func(w http.ResponseWriter, r *http.Request, p *packages.Package) {
+		sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		serve(sw, r, p)
+		if sw.code == http.StatusOK {
+			metrics.PackageDownloads.WithLabelValues(p.Name, p.Version, format).Inc()
+		}
+	}
+}
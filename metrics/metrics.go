@@ -0,0 +1,132 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package metrics contains the Prometheus metrics of the package registry.
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "epr"
+
+// Results of lookups in caches.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+var (
+	// HTTPRequests counts the requests served, by route template.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests served.",
+	}, []string{"method", "path", "code"})
+
+	// HTTPRequestDuration measures the time taken to serve requests, by route template.
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	// HTTPResponseBytes counts the bytes of the bodies of responses, by route template.
+	HTTPResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "response_bytes_total",
+		Help:      "Number of bytes served in bodies of HTTP responses.",
+	}, []string{"path"})
+
+	// PackageDownloads counts the downloads of package artifacts.
+	PackageDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "package_downloads_total",
+		Help:      "Number of downloads of package artifacts.",
+	}, []string{"name", "version", "format"})
+
+	// IndexerLoadDuration measures the time taken by indexers to load their packages.
+	IndexerLoadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "indexer",
+		Name:      "load_duration_seconds",
+		Help:      "Time taken by indexers to load their packages.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+	}, []string{"indexer"})
+
+	// PackageValidationFailures counts the packages that couldn't be loaded because they are
+	// not valid.
+	PackageValidationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "package_validation_failures_total",
+		Help:      "Number of packages that failed to load because they are not valid.",
+	})
+
+	// CacheRequests counts the lookups in caches, by cache and result, so hit ratios can
+	// be calculated.
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Number of lookups in caches, by result.",
+	}, []string{"cache", "result"})
+)
+
+// IndexerPackages is the number of packages loaded by the indexers currently serving packages.
+// Indexers of the same kind are added up.
+var IndexerPackages = newPackagesCollector()
+
+// PackagesCollector collects the number of packages of the indexers at the time of collection,
+// so it is always consistent with the packages served, even after replacing the indexers.
+type PackagesCollector struct {
+	desc *prometheus.Desc
+
+	mu    sync.RWMutex
+	count func() map[string]int
+}
+
+func newPackagesCollector() *PackagesCollector {
+	c := &PackagesCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "indexer", "packages"),
+			"Number of packages loaded by indexers.",
+			[]string{"indexer"}, nil,
+		),
+	}
+	prometheus.MustRegister(c)
+	return c
+}
+
+// SetSource sets the function used to count the packages of each kind of indexer.
+func (c *PackagesCollector) SetSource(count func() map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count = count
+}
+
+// Describe implements prometheus.Collector.
+func (c *PackagesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *PackagesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	count := c.count
+	c.mu.RUnlock()
+	if count == nil {
+		return
+	}
+
+	for indexer, n := range count() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), indexer)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/metrics"
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestMetrics(t *testing.T) {
+	indexer := packages.NewZipFileSystemIndexer("./testdata/local-storage")
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	config := defaultConfig
+	config.Auth.Tokens = []TokenConfig{{Token: "writer", Scopes: []string{scopeWrite}}}
+	router := newReindexer(apm.DefaultTracer)
+	err = router.init(&config, NewCombinedIndexer(indexer))
+	require.NoError(t, err)
+
+	serve := func(endpoint string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, endpoint, nil)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	requests := metrics.HTTPRequests.WithLabelValues(http.MethodGet, artifactsRouterPath, "200")
+	notFoundRequests := metrics.HTTPRequests.WithLabelValues(http.MethodGet, artifactsRouterPath, "404")
+	responseBytes := metrics.HTTPResponseBytes.WithLabelValues(artifactsRouterPath)
+	downloads := metrics.PackageDownloads.WithLabelValues("example", "1.0.1", "zip")
+	cacheHits := metrics.CacheRequests.WithLabelValues("response", metrics.CacheHit)
+
+	initialRequests := testutil.ToFloat64(requests)
+	initialNotFoundRequests := testutil.ToFloat64(notFoundRequests)
+	initialResponseBytes := testutil.ToFloat64(responseBytes)
+	initialDownloads := testutil.ToFloat64(downloads)
+	initialCacheHits := testutil.ToFloat64(cacheHits)
+
+	recorder := serve("/epr/example/example-1.0.1.zip")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	serve("/epr/example/example-1.0.1.zip")
+
+	// Partial and not modified responses are not counted as downloads.
+	req := httptest.NewRequest(http.MethodGet, "/epr/example/example-1.0.1.zip", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	partial := httptest.NewRecorder()
+	router.ServeHTTP(partial, req)
+	require.Equal(t, http.StatusPartialContent, partial.Code)
+	req = httptest.NewRequest(http.MethodGet, "/epr/example/example-1.0.1.zip", nil)
+	req.Header.Set("If-None-Match", recorder.Header().Get("ETag"))
+	notModified := httptest.NewRecorder()
+	router.ServeHTTP(notModified, req)
+	require.Equal(t, http.StatusNotModified, notModified.Code)
+	serve("/epr/example/example-9.9.9.zip")
+	serve("/search?package=example")
+	serve("/search?package=example")
+
+	assert.Equal(t, initialRequests+2, testutil.ToFloat64(requests))
+	assert.Equal(t, initialNotFoundRequests+1, testutil.ToFloat64(notFoundRequests))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(responseBytes), initialResponseBytes+float64(2*recorder.Body.Len()))
+	assert.Equal(t, initialDownloads+2, testutil.ToFloat64(downloads))
+	assert.Equal(t, initialCacheHits+1, testutil.ToFloat64(cacheHits))
+
+	assert.Equal(t, http.StatusUnauthorized, serveWithToken(router, "", metricsRouterPath).Code)
+
+	recorder = serveWithToken(router, "writer", metricsRouterPath)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `epr_package_downloads_total{format="zip",name="example",version="1.0.1"}`)
+	assert.Contains(t, recorder.Body.String(), `epr_indexer_packages{indexer="ZipFileSystemIndexer"} 1`)
+}
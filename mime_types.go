@@ -5,14 +5,20 @@
 package main
 
 import (
-	"log"
 	"mime"
 )
 
+// compressedMimeTypes contains the MIME types whose content is already compressed, so it is not
+// compressed again when served.
+var compressedMimeTypes = make(map[string]bool)
+
 // init method defines MIME types important for the package content. Definitions ensure that the same Content-Type
 // will be returned if the /etc/mime.types is empty or tiny.
 func init() {
-	mustAddMimeExtensionType(".zip", "application/zip")
+	mustAddCompressedMimeExtensionType(".zip", "application/zip")
+	mustAddCompressedMimeExtensionType(".gz", "application/gzip")
+	mustAddCompressedMimeExtensionType(".png", "image/png")
+	mustAddCompressedMimeExtensionType(".jpg", "image/jpeg")
 	mustAddMimeExtensionType(".ico", "image/x-icon")
 	mustAddMimeExtensionType(".md", "text/markdown; charset=utf-8")
 	mustAddMimeExtensionType(".yml", "text/yaml; charset=UTF-8")
@@ -21,6 +27,20 @@ func init() {
 func mustAddMimeExtensionType(ext, typ string) {
 	err := mime.AddExtensionType(ext, typ)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+}
+
+func mustAddCompressedMimeExtensionType(ext, typ string) {
+	mustAddMimeExtensionType(ext, typ)
+	compressedMimeTypes[typ] = true
+}
+
+// isCompressedMimeType checks if a Content-Type corresponds to content that is already compressed.
+func isCompressedMimeType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
 	}
+	return compressedMimeTypes[mediaType]
 }
@@ -46,6 +46,7 @@ func packageIndexHandler(indexer Indexer, cacheTime time.Duration) func(w http.R
 		}
 
 		opts := packages.NameVersionFilter(packageName, packageVersion)
+		restrictFilter(r.Context(), opts.Filter)
 		packages, err := indexer.Get(r.Context(), &opts)
 		if err != nil {
 			log.Printf("getting package path failed: %v", err)
@@ -57,15 +58,18 @@ func packageIndexHandler(indexer Indexer, cacheTime time.Duration) func(w http.R
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		cacheHeaders(w, cacheTime)
-
-		err = util.WriteJSONPretty(w, packages[0])
+		// Packages are shared between requests, the checksum is set in a copy.
+		index := *packages[0]
+		index.SHA256 = packageDigest(packages[0])
+		body, err := util.MarshalJSONPretty(&index)
 		if err != nil {
 			log.Printf("marshaling package index failed (path '%s'): %v", packages[0].BasePath, err)
 
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
+
+		cacheHeaders(w, cacheTime)
+		writeJSON(w, r, body)
 	}
 }
@@ -0,0 +1,224 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/archiver"
+	"github.com/elastic/package-registry/metrics"
+)
+
+// archiveCacheFormat is included in the keys of the archive cache, it has to be increased when
+// the way archives are built changes, so archives built in other ways are not reused.
+const archiveCacheFormat = 2
+
+// ArchiveCache stores in disk the archives built for extracted packages, so they don't need to be
+// built on every download. Archives are addressed by the path of the package and a fingerprint of
+// its files, so they are built again if any file changes. Archives are reproducible, so the same
+// content produces the same archive.
+type ArchiveCache struct {
+	path string
+
+	mu sync.Mutex
+
+	// building contains the archives being built, by path, so concurrent requests for the same
+	// archive wait for it instead of building it again.
+	building map[string]*archiveBuild
+
+	// current contains the last archive built for each package path and format, to remove it
+	// when it is replaced.
+	current map[string]string
+}
+
+type archiveBuild struct {
+	done chan struct{}
+	err  error
+}
+
+// NewArchiveCache creates an archive cache that stores archives in the given directory.
+func NewArchiveCache(path string) (*ArchiveCache, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating archive cache directory failed (path: %s)", path)
+	}
+	return &ArchiveCache{
+		path:     path,
+		building: make(map[string]*archiveBuild),
+		current:  make(map[string]string),
+	}, nil
+}
+
+func (c *ArchiveCache) servePackage(w http.ResponseWriter, r *http.Request, p *Package) {
+	c.serveArchive(w, r, p, archiver.FormatZip)
+}
+
+func (c *ArchiveCache) servePackageTarGz(w http.ResponseWriter, r *http.Request, p *Package) {
+	c.serveArchive(w, r, p, archiver.FormatTarGz)
+}
+
+func (c *ArchiveCache) serveFile(w http.ResponseWriter, r *http.Request, p *Package, name string) {
+	serveFileFromFileSystem(w, r, p, name)
+}
+
+func (c *ArchiveCache) serveSignature(w http.ResponseWriter, r *http.Request, p *Package) {
+	serveSignatureFromFileSystem(w, r, p)
+}
+
+// serveArchive serves the archive of the package in the given format, from the cache if the
+// package is extracted.
+func (c *ArchiveCache) serveArchive(w http.ResponseWriter, r *http.Request, p *Package, format archiver.Format) {
+	info, err := os.Stat(p.BasePath)
+	if err != nil {
+		log.Printf("stat package path '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		if format == archiver.FormatTarGz {
+			servePackageTarGzFromFileSystem(w, r, p)
+		} else {
+			servePackageFromFileSystem(w, r, p)
+		}
+		return
+	}
+
+	key, err := archiveKey(p.BasePath)
+	if err != nil {
+		log.Printf("fingerprinting package path '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	archivePath, err := c.archive(p, format, key)
+	if err != nil {
+		log.Printf("archiving package path '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		log.Printf("opening cached archive '%s' failed: %v", archivePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		log.Printf("stat cached archive '%s' failed: %v", archivePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s.%s"`, key, format))
+	}
+	http.ServeContent(w, r, filepath.Base(archivePath), stat.ModTime(), f)
+}
+
+// archive returns the path of the archive of the package with the given key and format, building
+// it if it is not in the cache.
+func (c *ArchiveCache) archive(p *Package, format archiver.Format, key string) (string, error) {
+	archivePath := filepath.Join(c.path, fmt.Sprintf("%s-%s-%s.%s", p.Name, p.Version, key, format))
+	currentKey := string(format) + "\x00" + p.BasePath
+
+	c.mu.Lock()
+	if build, found := c.building[archivePath]; found {
+		c.mu.Unlock()
+		metrics.CacheRequests.WithLabelValues("archive", metrics.CacheHit).Inc()
+		<-build.done
+		return archivePath, build.err
+	}
+	if _, err := os.Stat(archivePath); err == nil {
+		c.mu.Unlock()
+		metrics.CacheRequests.WithLabelValues("archive", metrics.CacheHit).Inc()
+		return archivePath, nil
+	}
+	metrics.CacheRequests.WithLabelValues("archive", metrics.CacheMiss).Inc()
+	build := &archiveBuild{done: make(chan struct{})}
+	c.building[archivePath] = build
+	c.mu.Unlock()
+
+	build.err = buildArchive(archivePath, format, p)
+
+	c.mu.Lock()
+	delete(c.building, archivePath)
+	previous := c.current[currentKey]
+	if build.err == nil {
+		c.current[currentKey] = archivePath
+	}
+	c.mu.Unlock()
+	close(build.done)
+
+	if build.err == nil && previous != "" && previous != archivePath {
+		err := os.Remove(previous)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("removing outdated archive '%s' failed: %v", previous, err)
+		}
+	}
+	return archivePath, build.err
+}
+
+// buildArchive builds the archive of a package in a temporary file, and moves it to its final
+// path once complete, so incomplete archives are never served.
+func buildArchive(archivePath string, format archiver.Format, p *Package) error {
+	f, err := ioutil.TempFile(filepath.Dir(archivePath), ".building-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file failed")
+	}
+	defer os.Remove(f.Name())
+
+	properties := archiveProperties(p)
+	if format == archiver.FormatTarGz {
+		err = archiver.ArchivePackageTarGz(f, properties)
+	} else {
+		err = archiver.ArchivePackage(f, properties)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing temporary file failed")
+	}
+
+	return os.Rename(f.Name(), archivePath)
+}
+
+// archiveKey builds the key of the archive of an extracted package, from its path and the
+// metadata of its files.
+func archiveKey(packagePath string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", archiveCacheFormat, packagePath)
+	err := filepath.Walk(packagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(packagePath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00", relativePath, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
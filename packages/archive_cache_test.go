@@ -0,0 +1,111 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/util"
+)
+
+func TestArchiveCache(t *testing.T) {
+	packagesPath := t.TempDir()
+	packagePath := filepath.Join(packagesPath, "example", "1.0.0")
+	require.NoError(t, util.CopyDir("../testdata/package/example/1.0.0", packagePath))
+
+	cachePath := t.TempDir()
+	cache, err := NewArchiveCache(cachePath)
+	require.NoError(t, err)
+
+	indexer := NewFileSystemIndexer(packagesPath)
+	indexer.SetArchiveCache(cache)
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	p := packages[0]
+
+	download := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/epr/example/example-1.0.0.zip", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		ServePackage(recorder, req, p)
+		return recorder
+	}
+	cachedArchives := func() []string {
+		entries, err := ioutil.ReadDir(cachePath)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	first := download(nil)
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "application/gzip", first.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(first.Body.Len()), first.Header().Get("Content-Length"))
+	assert.NotEmpty(t, first.Header().Get("Last-Modified"))
+	etag := first.Header().Get("ETag")
+	sum := sha256.Sum256(first.Body.Bytes())
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, etag)
+	assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]), first.Header().Get("Digest"))
+	archives := cachedArchives()
+	assert.Len(t, archives, 1)
+
+	second := download(nil)
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	assert.Equal(t, archives, cachedArchives())
+
+	partial := download(map[string]string{"Range": "bytes=100-199"})
+	assert.Equal(t, http.StatusPartialContent, partial.Code)
+	assert.Equal(t, first.Body.Bytes()[100:200], partial.Body.Bytes())
+
+	notModified := download(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+
+	// Archives are built again when files change, and outdated archives are removed. Archives
+	// are reproducible, so they don't change if only the metadata of the files changes.
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(packagePath, "docs", "README.md"), future, future)
+	require.NoError(t, err)
+
+	updated := download(nil)
+	require.Equal(t, http.StatusOK, updated.Code)
+	assert.Equal(t, first.Body.Bytes(), updated.Body.Bytes())
+	updatedArchives := cachedArchives()
+	assert.Len(t, updatedArchives, 1)
+	assert.NotEqual(t, archives, updatedArchives)
+	assert.Equal(t, etag, updated.Header().Get("ETag"))
+
+	// Checksums are computed again when the content changes.
+	err = ioutil.WriteFile(filepath.Join(packagePath, "docs", "README.md"), []byte("# Changed\n"), 0644)
+	require.NoError(t, err)
+
+	changed := download(map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusOK, changed.Code)
+	sum = sha256.Sum256(changed.Body.Bytes())
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, changed.Header().Get("ETag"))
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+}
@@ -0,0 +1,191 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/archiver"
+	"github.com/elastic/package-registry/metrics"
+)
+
+// localPackageDigest computes the SHA-256 checksum of a zipped package available in the local
+// file system. Packages that are archived when served don't have a checksum at index time, their
+// checksums are computed lazily by a digestCache.
+func localPackageDigest(p *Package) (string, error) {
+	if !strings.HasSuffix(p.BasePath, ".zip") {
+		return "", nil
+	}
+	h := sha256.New()
+	err := copyFile(h, p.BasePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "computing checksum failed (path: %s)", p.BasePath)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digester obtains the checksums of packages that are not known when they are indexed.
+type digester interface {
+	// digest returns the checksum of the package, computing it if needed.
+	digest(p *Package) (string, error)
+
+	// knownDigest returns the checksum of the package if it can be obtained without
+	// downloading the package, otherwise it returns an empty string.
+	knownDigest(p *Package) (string, error)
+}
+
+// digestCache keeps the checksums of the zip artifacts of packages that are archived when served,
+// extracted packages and packages archived as tar.gz. Checksums are computed the first time they
+// are needed, and kept while the files of the package don't change.
+type digestCache struct {
+	// archives is the cache of archives of extracted packages, if any. Checksums of extracted
+	// packages are computed from their cached archives, so they are archived only once.
+	archives *ArchiveCache
+
+	mu      sync.Mutex
+	digests map[string]cachedDigest
+}
+
+// cachedDigest is the checksum of the artifact of a package, for the key of its files.
+type cachedDigest struct {
+	key    string
+	digest string
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{digests: make(map[string]cachedDigest)}
+}
+
+// digest returns the SHA-256 checksum of the zip artifact of the package, computing it if the
+// files of the package changed since it was last computed.
+func (c *digestCache) digest(p *Package) (string, error) {
+	key, err := artifactKey(p.BasePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "fingerprinting package failed (path: %s)", p.BasePath)
+	}
+
+	c.mu.Lock()
+	cached, found := c.digests[p.BasePath]
+	c.mu.Unlock()
+	if found && cached.key == key {
+		metrics.CacheRequests.WithLabelValues("digest", metrics.CacheHit).Inc()
+		return cached.digest, nil
+	}
+	metrics.CacheRequests.WithLabelValues("digest", metrics.CacheMiss).Inc()
+
+	h := sha256.New()
+	if info, err := os.Stat(p.BasePath); err == nil && info.IsDir() && c.archives != nil {
+		var archivePath string
+		archivePath, err = c.archives.archive(p, archiver.FormatZip, key)
+		if err == nil {
+			err = copyFile(h, archivePath)
+		}
+	} else {
+		err = writeLocalArtifact(h, p)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "computing checksum failed (path: %s)", p.BasePath)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	c.digests[p.BasePath] = cachedDigest{key: key, digest: digest}
+	c.mu.Unlock()
+	return digest, nil
+}
+
+// knownDigest returns the checksum of the package. Packages are available in the local file
+// system, so their checksums are computed if needed.
+func (c *digestCache) knownDigest(p *Package) (string, error) {
+	return c.digest(p)
+}
+
+// retain removes the checksums of packages that are not in the given list.
+func (c *digestCache) retain(packageList Packages) {
+	paths := make(map[string]struct{}, len(packageList))
+	for _, p := range packageList {
+		paths[p.BasePath] = struct{}{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.digests {
+		if _, found := paths[path]; !found {
+			delete(c.digests, path)
+		}
+	}
+}
+
+// artifactKey builds a key that changes when the files of a package available in the local
+// file system change. For extracted packages it is the key of their archives in the archive cache.
+func artifactKey(packagePath string) (string, error) {
+	info, err := os.Stat(packagePath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return archiveKey(packagePath)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%d\x00%d\x00", archiveCacheFormat, packagePath, info.Size(), info.ModTime().UnixNano())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeLocalArtifact writes the zip artifact of a package available in the local file system,
+// with the same content it has when served.
+func writeLocalArtifact(w io.Writer, p *Package) error {
+	info, err := os.Stat(p.BasePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		return archiver.ArchivePackage(w, archiveProperties(p))
+	case strings.HasSuffix(p.BasePath, ".tar.gz"):
+		return archiveConverted(w, p, archiver.FormatZip)
+	default:
+		return copyFile(w, p.BasePath)
+	}
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// readChecksum reads a SHA-256 checksum in the format used by sha256sum, where the first
+// field of the first line is the hex-encoded checksum.
+func readChecksum(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum")
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return "", errors.Errorf("invalid SHA-256 checksum %q", fields[0])
+	}
+	return strings.ToLower(fields[0]), nil
+}
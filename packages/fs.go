@@ -11,8 +11,11 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+
+	"github.com/elastic/package-registry/archiver"
 )
 
 // PackageFile is the interface that files in the file system need to implement.
@@ -26,6 +29,12 @@ type PackageFileSystem interface {
 	Close() error
 }
 
+// archivableFileSystem is implemented by file systems that can list all the files of the
+// package, so the package can be archived in other formats.
+type archivableFileSystem interface {
+	archiveFiles() []archiver.File
+}
+
 // ExtractedPackageFileSystem provides utils to access files in an extracted package.
 type ExtractedPackageFileSystem struct {
 	path string
@@ -63,7 +72,8 @@ func (fs *ExtractedPackageFileSystem) Close() error { return nil }
 // ZipPackageFileSystem provides utils to access files in a zipped package.
 type ZipPackageFileSystem struct {
 	root   string
-	reader *zip.ReadCloser
+	reader *zip.Reader
+	closer io.Closer
 }
 
 func NewZipPackageFileSystem(p *Package) (*ZipPackageFileSystem, error) {
@@ -71,6 +81,17 @@ func NewZipPackageFileSystem(p *Package) (*ZipPackageFileSystem, error) {
 	if err != nil {
 		return nil, err
 	}
+	fs, err := newZipPackageFileSystem(&reader.Reader, reader, p.BasePath)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// newZipPackageFileSystem creates a file system for a zipped package read with the given reader.
+// The closer, if any, is closed when the file system is closed.
+func newZipPackageFileSystem(reader *zip.Reader, closer io.Closer, path string) (*ZipPackageFileSystem, error) {
 	var root string
 	found := false
 	for _, f := range reader.File {
@@ -83,11 +104,12 @@ func NewZipPackageFileSystem(p *Package) (*ZipPackageFileSystem, error) {
 		}
 	}
 	if !found {
-		return nil, fmt.Errorf("failed to determine root directory in package (path: %s)", p.BasePath)
+		return nil, fmt.Errorf("failed to determine root directory in package (path: %s)", path)
 	}
 	return &ZipPackageFileSystem{
 		root:   root,
 		reader: reader,
+		closer: closer,
 	}, nil
 }
 
@@ -129,15 +151,37 @@ func (fs *ZipPackageFileSystem) Glob(pattern string) (matches []string, err erro
 	return
 }
 
+func (fs *ZipPackageFileSystem) archiveFiles() []archiver.File {
+	var files []archiver.File
+	for _, f := range fs.reader.File {
+		name := path.Clean(filepath.ToSlash(f.Name))
+		if !strings.HasPrefix(name, fs.root+"/") {
+			continue
+		}
+		f := f
+		files = append(files, archiver.File{
+			Name: strings.TrimPrefix(name, fs.root+"/"),
+			Info: f.FileInfo(),
+			Open: func() (io.ReadCloser, error) {
+				return f.Open()
+			},
+		})
+	}
+	return files
+}
+
 func (fs *ZipPackageFileSystem) Close() error {
-	return fs.reader.Close()
+	if fs.closer == nil {
+		return nil
+	}
+	return fs.closer.Close()
 }
 
 // zipFileSeeker implements the seeker interface for zip files.
 type zipFileSeeker struct {
 	fs.File
 
-	reader *zip.ReadCloser
+	reader *zip.Reader
 	path   string
 }
 
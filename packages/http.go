@@ -5,19 +5,52 @@
 package packages
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"go.elastic.co/apm"
 
 	"github.com/elastic/package-registry/archiver"
 )
 
+// packageServer is implemented by backends that serve the content of their packages by
+// themselves, instead of reading it from the local file system.
+type packageServer interface {
+	servePackage(w http.ResponseWriter, r *http.Request, p *Package)
+	servePackageTarGz(w http.ResponseWriter, r *http.Request, p *Package)
+	serveFile(w http.ResponseWriter, r *http.Request, p *Package, name string)
+	serveSignature(w http.ResponseWriter, r *http.Request, p *Package)
+}
+
 func ServePackage(w http.ResponseWriter, r *http.Request, p *Package) {
 	span, _ := apm.StartSpan(r.Context(), "ServePackage", "app")
 	defer span.End()
 
+	setDigestHeaders(w, p)
+
+	if p.server != nil {
+		p.server.servePackage(w, r, p)
+		return
+	}
+
+	servePackageFromFileSystem(w, r, p)
+}
+
+// servePackageFromFileSystem serves a package available in the local file system, archiving
+// it if it is extracted. Archives built on the fly are reproducible, so they match the digest
+// of the package.
+func servePackageFromFileSystem(w http.ResponseWriter, r *http.Request, p *Package) {
 	packagePath := p.BasePath
 	f, err := os.Stat(packagePath)
 	if err != nil {
@@ -28,25 +61,199 @@ func ServePackage(w http.ResponseWriter, r *http.Request, p *Package) {
 
 	w.Header().Set("Content-Type", "application/gzip")
 
-	if f.IsDir() {
-		err = archiver.ArchivePackage(w, archiver.PackageProperties{
-			Name:    p.Name,
-			Version: p.Version,
-			Path:    packagePath,
+	if !strings.HasSuffix(packagePath, ".zip") && notModified(w, r) {
+		return
+	}
+
+	switch {
+	case f.IsDir():
+		serveBuiltArchive(w, r, p, archiver.FormatZip, latestModTime(packagePath), func(w io.Writer) error {
+			return archiver.ArchivePackage(w, archiveProperties(p))
 		})
-		if err != nil {
-			log.Printf("archiving package path '%s' failed: %v", packagePath, err)
-			return
-		}
-	} else {
+	case strings.HasSuffix(packagePath, ".tar.gz"):
+		servePackageConverted(w, r, p, archiver.FormatZip, f.ModTime())
+	default:
+		http.ServeFile(w, r, packagePath)
+	}
+}
+
+// ServePackageTarGz serves the package archived as tar.gz.
+func ServePackageTarGz(w http.ResponseWriter, r *http.Request, p *Package) {
+	span, _ := apm.StartSpan(r.Context(), "ServePackageTarGz", "app")
+	defer span.End()
+
+	if p.server != nil {
+		p.server.servePackageTarGz(w, r, p)
+		return
+	}
+
+	servePackageTarGzFromFileSystem(w, r, p)
+}
+
+// servePackageTarGzFromFileSystem serves a package available in the local file system as tar.gz,
+// archiving it if it is extracted or archived in other format.
+func servePackageTarGzFromFileSystem(w http.ResponseWriter, r *http.Request, p *Package) {
+	packagePath := p.BasePath
+	f, err := os.Stat(packagePath)
+	if err != nil {
+		log.Printf("stat package path '%s' failed: %v", packagePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+
+	switch {
+	case f.IsDir():
+		serveBuiltArchive(w, r, p, archiver.FormatTarGz, latestModTime(packagePath), func(w io.Writer) error {
+			return archiver.ArchivePackageTarGz(w, archiveProperties(p))
+		})
+	case strings.HasSuffix(packagePath, ".tar.gz"):
 		http.ServeFile(w, r, packagePath)
+	default:
+		servePackageConverted(w, r, p, archiver.FormatTarGz, f.ModTime())
+	}
+}
+
+// servePackageConverted archives again the files of an archived package, in the given format.
+func servePackageConverted(w http.ResponseWriter, r *http.Request, p *Package, format archiver.Format, modTime time.Time) {
+	serveBuiltArchive(w, r, p, format, modTime, func(w io.Writer) error {
+		return archiveConverted(w, p, format)
+	})
+}
+
+// serveBuiltArchive serves an archive of the package built on the fly. Archives are built in a
+// temporary file, so they are served with support for range and conditional requests, as the
+// archives served from the archive cache.
+func serveBuiltArchive(w http.ResponseWriter, r *http.Request, p *Package, format archiver.Format, modTime time.Time, build func(io.Writer) error) {
+	f, err := ioutil.TempFile("", "package-registry-archive-")
+	if err != nil {
+		log.Printf("creating temporary file for package '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = build(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("archiving package '%s' as %s failed: %v", p.BasePath, format, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, fmt.Sprintf("%s-%s.%s", p.Name, p.Version, format), modTime, f)
+}
+
+// latestModTime returns the latest modification time of the files in the given directory. Errors
+// are ignored, they are found when the directory is archived.
+func latestModTime(dir string) time.Time {
+	var latest time.Time
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// archiveConverted writes the files of an archived package to an archive in the given format.
+func archiveConverted(w io.Writer, p *Package, format archiver.Format) error {
+	fs, err := p.fs()
+	if err != nil {
+		return errors.Wrap(err, "failed to open filesystem for package")
+	}
+	defer fs.Close()
+
+	archivable, ok := fs.(archivableFileSystem)
+	if !ok {
+		return errors.Errorf("package cannot be archived as %s", format)
+	}
+	return archiver.ArchiveFiles(w, format, archiveProperties(p), archivable.archiveFiles())
+}
+
+// archiveProperties returns the properties used to archive the package. Archives are
+// reproducible, so the same package produces the same archive every time.
+func archiveProperties(p *Package) archiver.PackageProperties {
+	return archiver.PackageProperties{
+		Name:         p.Name,
+		Version:      p.Version,
+		Path:         p.BasePath,
+		Reproducible: true,
+	}
+}
+
+// setDigestHeaders sets the headers with the checksum of the zip artifact of the package, if known.
+func setDigestHeaders(w http.ResponseWriter, p *Package) {
+	digest, err := p.Digest()
+	if err != nil {
+		log.Printf("getting checksum of package '%s' failed: %v", p.BasePath, err)
+		return
+	}
+	if digest == "" {
+		return
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+	w.Header().Set("ETag", `"`+digest+`"`)
+}
+
+// notModified responds with a 304 status if the ETag of the response matches the request, it is
+// used for archives built on the fly, that are not served with http.ServeContent.
+func notModified(w http.ResponseWriter, r *http.Request) bool {
+	etag := w.Header().Get("ETag")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if etag == "" || ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
 	}
+	return false
+}
+
+// ServeChecksum serves the SHA-256 checksum of the zip artifact of the package, in the format
+// used by sha256sum.
+func ServeChecksum(w http.ResponseWriter, r *http.Request, p *Package) {
+	digest, err := p.Digest()
+	if err != nil {
+		log.Printf("getting checksum of package '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if digest == "" {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s  %s\n", digest, path.Base(p.GetDownloadPath()))
 }
 
 func ServeFile(w http.ResponseWriter, r *http.Request, p *Package, name string) {
 	span, _ := apm.StartSpan(r.Context(), "ServePackage", "app")
 	defer span.End()
 
+	if p.server != nil {
+		p.server.serveFile(w, r, p, name)
+		return
+	}
+
+	serveFileFromFileSystem(w, r, p, name)
+}
+
+// serveFileFromFileSystem serves a file of the package, reading it with the file system of the package.
+func serveFileFromFileSystem(w http.ResponseWriter, r *http.Request, p *Package, name string) {
 	fs, err := p.fs()
 	if os.IsNotExist(err) {
 		http.Error(w, "resource not found", http.StatusNotFound)
@@ -57,6 +264,7 @@ func ServeFile(w http.ResponseWriter, r *http.Request, p *Package, name string)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer fs.Close()
 
 	stat, err := fs.Stat(name)
 	if os.IsNotExist(err) {
@@ -81,5 +289,19 @@ func ServeFile(w http.ResponseWriter, r *http.Request, p *Package, name string)
 }
 
 func ServeSignature(w http.ResponseWriter, r *http.Request, p *Package) {
+	if p.signer != nil {
+		p.signer.serveSignature(w, r, p)
+		return
+	}
+
+	if p.server != nil {
+		p.server.serveSignature(w, r, p)
+		return
+	}
+
+	serveSignatureFromFileSystem(w, r, p)
+}
+
+func serveSignatureFromFileSystem(w http.ResponseWriter, r *http.Request, p *Package) {
 	http.ServeFile(w, r, p.BasePath+".sig")
 }
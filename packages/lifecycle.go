@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	ucfg "github.com/elastic/go-ucfg"
+	"github.com/elastic/go-ucfg/yaml"
+	"github.com/pkg/errors"
+)
+
+// lifecycleSuffix is the suffix of the files with the lifecycle of a package, stored along
+// with the package, as signatures are. The lifecycle of a package can be changed this way
+// without modifying the package.
+const lifecycleSuffix = ".lifecycle.yml"
+
+// Deprecation describes why a package is deprecated, and the package that replaces it, if any.
+type Deprecation struct {
+	Message    string `config:"message" json:"message" yaml:"message" validate:"required"`
+	ReplacedBy string `config:"replaced_by" json:"replaced_by,omitempty" yaml:"replaced_by,omitempty"`
+}
+
+// lifecycle is the content of a lifecycle file.
+type lifecycle struct {
+	// Yanked versions are not chosen as latest versions, but they can still be requested
+	// by their exact version.
+	Yanked bool `config:"yanked"`
+
+	Deprecated *Deprecation `config:"deprecated"`
+}
+
+// readLifecycle reads the lifecycle of a package from a lifecycle file.
+func readLifecycle(r io.Reader) (*lifecycle, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := yaml.NewConfig(content, ucfg.PathSep("."))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing lifecycle file failed")
+	}
+	var l lifecycle
+	err = cfg.Unpack(&l, ucfg.PathSep("."))
+	if err != nil {
+		return nil, errors.Wrap(err, "unpacking lifecycle file failed")
+	}
+	return &l, nil
+}
+
+// setLifecycle sets the lifecycle of the package, if it has any.
+func (p *Package) setLifecycle(l *lifecycle) {
+	if l == nil {
+		return
+	}
+	p.Yanked = l.Yanked
+	p.Deprecated = l.Deprecated
+}
+
+// loadLocalLifecycle reads the lifecycle file of a package stored in the local file system,
+// if there is any.
+func (p *Package) loadLocalLifecycle() error {
+	f, err := os.Open(p.BasePath + lifecycleSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	l, err := readLifecycle(f)
+	if err != nil {
+		return err
+	}
+	p.setLifecycle(l)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/util"
+)
+
+func TestLifecycle(t *testing.T) {
+	basePath := t.TempDir()
+	for _, version := range []string{"1.0.3", "1.0.4", "1.1.0"} {
+		require.NoError(t, util.CopyDir(filepath.Join("../testdata/package/multiversion", version), filepath.Join(basePath, "multiversion", version)))
+	}
+	writeLifecycle := func(version, content string) {
+		path := filepath.Join(basePath, "multiversion", version+lifecycleSuffix)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	writeLifecycle("1.1.0", "yanked: true\n")
+	writeLifecycle("1.0.4", "deprecated:\n  message: Use the example package.\n  replaced_by: example\n")
+
+	indexer := NewFileSystemIndexer(basePath)
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	t.Run("latest version", func(t *testing.T) {
+		packages, err := indexer.Get(context.Background(), &GetOptions{Filter: &Filter{PackageName: "multiversion"}})
+		require.NoError(t, err)
+		require.Len(t, packages, 1)
+		assert.Equal(t, "1.0.4", packages[0].Version)
+		assert.False(t, packages[0].Yanked)
+		assert.Equal(t, &Deprecation{Message: "Use the example package.", ReplacedBy: "example"}, packages[0].Deprecated)
+	})
+
+	t.Run("exact version", func(t *testing.T) {
+		opts := NameVersionFilter("multiversion", "1.1.0")
+		packages, err := indexer.Get(context.Background(), &opts)
+		require.NoError(t, err)
+		require.Len(t, packages, 1)
+		assert.True(t, packages[0].Yanked)
+		assert.Nil(t, packages[0].Deprecated)
+	})
+
+	t.Run("all versions", func(t *testing.T) {
+		packages, err := indexer.Get(context.Background(), &GetOptions{Filter: &Filter{PackageName: "multiversion", AllVersions: true}})
+		require.NoError(t, err)
+		assert.Len(t, packages, 3)
+	})
+}
+
+func TestLifecycleInvalid(t *testing.T) {
+	basePath := t.TempDir()
+	require.NoError(t, util.CopyDir("../testdata/package/multiversion/1.0.3", filepath.Join(basePath, "multiversion", "1.0.3")))
+	err := ioutil.WriteFile(filepath.Join(basePath, "multiversion", "1.0.3"+lifecycleSuffix), []byte("deprecated:\n  replaced_by: example\n"), 0644)
+	require.NoError(t, err)
+
+	indexer := NewFileSystemIndexer(basePath)
+	err = indexer.Init(context.Background())
+	assert.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/joeshaw/multierror"
 	"github.com/pkg/errors"
 
 	ucfg "github.com/elastic/go-ucfg"
@@ -68,7 +69,19 @@ type Package struct {
 	// Local path to the package dir
 	BasePath string `json:"-" yaml:"-"`
 
+	// Result of the verification of the signature of the package, only set if signatures are verified.
+	SignatureVerified *bool `json:"signature_verified,omitempty" yaml:"signature_verified,omitempty"`
+
 	fsBuilder FileSystemBuilder
+
+	// Server for the content of packages not available in the local file system.
+	server packageServer
+
+	// Signer for packages signed by the registry.
+	signer *PackageSigner
+
+	// Source of the checksums of packages whose checksum is not known at index time.
+	digests digester
 }
 
 type FileSystemBuilder func(*Package) (PackageFileSystem, error)
@@ -90,6 +103,14 @@ type BasePackage struct {
 	Owner               *Owner               `config:"owner,omitempty" json:"owner,omitempty" yaml:"owner,omitempty"`
 	Categories          []string             `config:"categories,omitempty" json:"categories,omitempty" yaml:"categories,omitempty"`
 	SignaturePath       string               `config:"signature_path,omitempty" json:"signature_path,omitempty" yaml:"signature_path,omitempty"`
+	SHA256              string               `config:"sha256,omitempty" json:"sha256,omitempty" yaml:"sha256,omitempty"`
+
+	// Lifecycle of the package, read from its lifecycle file and not from its manifest.
+	Yanked     bool         `config:"yanked,ignore" json:"yanked,omitempty" yaml:"yanked,omitempty"`
+	Deprecated *Deprecation `config:"deprecated,ignore" json:"deprecated,omitempty" yaml:"deprecated,omitempty"`
+
+	// Relevance of the package for a full-text query, only set in search results.
+	Score float64 `json:"score,omitempty" yaml:"score,omitempty"`
 }
 
 // BasePolicyTemplate is used for the package policy templates in the /search endpoint
@@ -320,6 +341,11 @@ func NewPackage(basePath string, fsBuilder FileSystemBuilder) (*Package, error)
 	if err != nil {
 		return nil, errors.Wrapf(err, "can't process the package signature")
 	}
+
+	err = p.loadLocalLifecycle()
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't process the package lifecycle")
+	}
 	return p, nil
 }
 
@@ -336,6 +362,34 @@ func (p *Package) HasPolicyTemplateWithCategory(category string) bool {
 	return false
 }
 
+// HasDataStreamType checks if the package has any data stream of the given type.
+func (p *Package) HasDataStreamType(dataStreamType string) bool {
+	for _, d := range p.DataStreams {
+		if d.Type == dataStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+// HasInput checks if any policy template of the package offers the given input type.
+func (p *Package) HasInput(input string) bool {
+	return util.StringsContains(p.InputTypes(), input)
+}
+
+// InputTypes returns the input types offered by the policy templates of the package, without duplicates.
+func (p *Package) InputTypes() []string {
+	var inputs []string
+	for _, t := range p.PolicyTemplates {
+		for _, i := range t.Inputs {
+			if !util.StringsContains(inputs, i.Type) {
+				inputs = append(inputs, i.Type)
+			}
+		}
+	}
+	return inputs
+}
+
 func (p *Package) HasKibanaVersion(version *semver.Version) bool {
 	// If the version is not specified, it is for all versions
 	if p.Conditions == nil || p.Conditions.Kibana == nil || p.Conditions.Kibana.constraint == nil || version == nil {
@@ -345,6 +399,14 @@ func (p *Package) HasKibanaVersion(version *semver.Version) bool {
 	return p.Conditions.Kibana.constraint.Check(version)
 }
 
+// title returns the title of the package, or its name if it has no title.
+func (p *Package) title() string {
+	if p.Title == nil {
+		return p.Name
+	}
+	return *p.Title
+}
+
 func (p *Package) IsNewerOrEqual(pp *Package) bool {
 	return !p.versionSemVer.LessThan(pp.versionSemVer)
 }
@@ -417,65 +479,72 @@ func (p *Package) fs() (PackageFileSystem, error) {
 
 // Validate is called during Unpack of the manifest.
 // The validation here is only related to the fields directly specified in the manifest itself.
+// All the problems found are reported, not only the first one.
 func (p *Package) Validate() error {
 	if ValidationDisabled {
 		return nil
 	}
 
+	var errs multierror.Errors
 	if p.FormatVersion == "" {
-		return fmt.Errorf("no format_version set: %v", p)
-	}
-
-	_, err := semver.StrictNewVersion(p.FormatVersion)
-	if err != nil {
-		return fmt.Errorf("invalid package version: %s, %s", p.FormatVersion, err)
+		errs = append(errs, fmt.Errorf("no format_version set: %v", p))
+	} else if _, err := semver.StrictNewVersion(p.FormatVersion); err != nil {
+		errs = append(errs, fmt.Errorf("invalid package version: %s, %s", p.FormatVersion, err))
 	}
 
-	_, err = semver.StrictNewVersion(p.Version)
-	if err != nil {
-		return err
+	_, versionErr := semver.StrictNewVersion(p.Version)
+	if versionErr != nil {
+		errs = append(errs, versionErr)
 	}
 
 	if p.Title == nil || *p.Title == "" {
-		return fmt.Errorf("no title set for package: %s", p.Name)
+		errs = append(errs, fmt.Errorf("no title set for package: %s", p.Name))
 	}
 
 	if p.Description == "" {
-		return fmt.Errorf("no description set")
+		errs = append(errs, fmt.Errorf("no description set"))
 	}
 
 	for _, c := range p.Categories {
 		if _, ok := CategoryTitles[c]; !ok {
-			return fmt.Errorf("invalid category: %s", c)
+			errs = append(errs, fmt.Errorf("invalid category: %s", c))
 		}
 	}
 
 	fs, err := p.fs()
 	if err != nil {
-		return err
+		return append(errs, err).Err()
 	}
 	defer fs.Close()
 
 	for _, i := range p.Icons {
 		_, err := fs.Stat(i.Src)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
 	for _, s := range p.Screenshots {
 		_, err := fs.Stat(s.Src)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
-	err = p.validateVersionConsistency()
-	if err != nil {
-		return errors.Wrap(err, "version in manifest file is not consistent with path")
+	if versionErr == nil {
+		err = p.validateVersionConsistency()
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "version in manifest file is not consistent with path"))
+		}
 	}
 
-	return p.ValidateDataStreams()
+	err = p.ValidateDataStreams()
+	if multiErr, ok := err.(*multierror.MultiError); ok {
+		errs = append(errs, multiErr.Errors...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	return errs.Err()
 }
 
 func (p *Package) validateVersionConsistency() error {
@@ -556,28 +625,31 @@ func (p *Package) LoadDataSets() error {
 	return nil
 }
 
-// ValidateDataStreams loads all dataStreams and with it validates them
+// ValidateDataStreams loads all dataStreams and with it validates them. The problems found in
+// all the data streams are reported.
 func (p *Package) ValidateDataStreams() error {
 	dataStreamPaths, err := p.GetDataStreamPaths()
 	if err != nil {
 		return err
 	}
 
+	var errs multierror.Errors
 	dataStreamsBasePath := "data_stream"
 	for _, dataStreamPath := range dataStreamPaths {
 		dataStreamBasePath := filepath.Join(dataStreamsBasePath, dataStreamPath)
 
 		d, err := NewDataStream(dataStreamBasePath, p)
 		if err != nil {
-			return errors.Wrapf(err, "building data stream failed (path: %s)", dataStreamBasePath)
+			errs = append(errs, errors.Wrapf(err, "building data stream failed (path: %s)", dataStreamBasePath))
+			continue
 		}
 
 		err = d.Validate()
 		if err != nil {
-			return errors.Wrapf(err, "validating data stream failed (path: %s)", dataStreamBasePath)
+			errs = append(errs, errors.Wrapf(err, "validating data stream failed (path: %s)", dataStreamBasePath))
 		}
 	}
-	return nil
+	return errs.Err()
 }
 
 func (p *Package) GetPath() string {
@@ -588,6 +660,31 @@ func (p *Package) GetDownloadPath() string {
 	return path.Join("/epr", p.Name, p.Name+"-"+p.Version+".zip")
 }
 
+// Digest returns the SHA-256 checksum of the zip artifact of the package. Checksums not known
+// at index time are computed when needed. It returns an empty string if the checksum is unknown.
+func (p *Package) Digest() (string, error) {
+	if p.SHA256 != "" || p.digests == nil {
+		return p.SHA256, nil
+	}
+	return p.digests.digest(p)
+}
+
+// MetadataDigest returns the SHA-256 checksum of the zip artifact of the package to include in
+// its metadata. Checksums of packages in the local file system are computed when needed, but
+// checksums of remote packages are only included if known, so they are not downloaded to
+// list them. It returns an empty string if the checksum is unknown.
+func (p *Package) MetadataDigest() (string, error) {
+	if p.SHA256 != "" || p.digests == nil {
+		return p.SHA256, nil
+	}
+	return p.digests.knownDigest(p)
+}
+
+// GetTarGzDownloadPath returns the path to download the package archived as tar.gz.
+func (p *Package) GetTarGzDownloadPath() string {
+	return path.Join("/epr", p.Name, p.Name+"-"+p.Version+".tar.gz")
+}
+
 func (p *Package) GetUrlPath() string {
 	return path.Join(packagePathPrefix, p.Name, p.Version)
 }
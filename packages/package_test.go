@@ -5,7 +5,9 @@
 package packages
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -127,6 +129,23 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateReportsAllProblems(t *testing.T) {
+	p := Package{
+		BasePackage: BasePackage{
+			Version:    "1.2.3",
+			Categories: []string{"custom", "unknown"},
+		},
+		FormatVersion: "1.0.0",
+	}
+	err := p.Validate()
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"no title set for package: ",
+		"no description set",
+		"invalid category: unknown",
+	}, validationProblems(err))
+}
+
 var kibanaVersionPackageTests = []struct {
 	description   string
 	constraint    string
@@ -250,6 +269,44 @@ func TestNewPackageFromPath(t *testing.T) {
 	}
 }
 
+func TestNewTarGzPackage(t *testing.T) {
+	zipPackage, err := NewPackage("../testdata/local-storage/example-1.0.1.zip", func(p *Package) (PackageFileSystem, error) {
+		return NewZipPackageFileSystem(p)
+	})
+	require.NoError(t, err)
+
+	tarGzPackage, err := NewPackage("../testdata/tar-storage/example-1.0.1.tar.gz", func(p *Package) (PackageFileSystem, error) {
+		return NewTarGzPackageFileSystem(p)
+	})
+	require.NoError(t, err)
+
+	// The signature of the zip package is not valid for the tar.gz package.
+	expected := zipPackage.BasePackage
+	expected.SignaturePath = ""
+	assert.Equal(t, expected, tarGzPackage.BasePackage)
+	assert.Equal(t, zipPackage.Assets, tarGzPackage.Assets)
+
+	fs, err := NewTarGzPackageFileSystem(tarGzPackage)
+	require.NoError(t, err)
+	defer fs.Close()
+
+	// Files can be read in any order.
+	for _, name := range []string{"docs/README.md", "manifest.yml", "docs/README.md"} {
+		f, err := fs.Open(name)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		f.Close()
+
+		stat, err := fs.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, stat.Size(), int64(len(content)), name)
+	}
+
+	_, err = fs.Open("missing.yml")
+	assert.True(t, os.IsNotExist(err))
+}
+
 func BenchmarkNewPackage(b *testing.B) {
 	fsBuilder := func(p *Package) (PackageFileSystem, error) {
 		return NewExtractedPackageFileSystem(p)
@@ -7,15 +7,20 @@ package packages
 import (
 	"archive/zip"
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.elastic.co/apm"
 
+	"github.com/elastic/package-registry/metrics"
 	"github.com/elastic/package-registry/util"
 )
 
@@ -28,16 +33,102 @@ type Packages []*Package
 func (p Packages) Len() int      { return len(p) }
 func (p Packages) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p Packages) Less(i, j int) bool {
+	if p[i].Score != p[j].Score {
+		return p[i].Score > p[j].Score
+	}
 	if p[i].Title != nil && p[j].Title != nil && *p[i].Title != *p[j].Title {
 		return *p[i].Title < *p[j].Title
 	}
-	return p[i].Version < p[j].Version
+	return compareVersions(p[i], p[j]) < 0
+}
+
+// Fields that can be used to sort packages.
+const (
+	SortByName    = "name"
+	SortByTitle   = "title"
+	SortByVersion = "version"
+	SortByRelease = "release"
+)
+
+// SortBy sorts the packages by the given field, in descending order if desc is set. Packages
+// with the same value are sorted by name and version, in ascending order. Releases are sorted
+// by maturity.
+func (p Packages) SortBy(field string, desc bool) error {
+	var compare func(p1, p2 *Package) int
+	switch field {
+	case SortByName:
+		compare = func(p1, p2 *Package) int { return strings.Compare(p1.Name, p2.Name) }
+	case SortByTitle:
+		compare = func(p1, p2 *Package) int { return strings.Compare(p1.title(), p2.title()) }
+	case SortByVersion:
+		compare = compareVersions
+	case SortByRelease:
+		compare = func(p1, p2 *Package) int { return releaseMaturity[p1.Release] - releaseMaturity[p2.Release] }
+	default:
+		return fmt.Errorf("unknown sort field '%s'", field)
+	}
+
+	sort.SliceStable(p, func(i, j int) bool {
+		c := compare(p[i], p[j])
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			c = strings.Compare(p[i].Name, p[j].Name)
+		}
+		if c == 0 {
+			c = compareVersions(p[i], p[j])
+		}
+		return c < 0
+	})
+	return nil
+}
+
+// compareVersions compares the versions of two packages. It returns a negative value if
+// the version of the first package is lower, and a positive one if it is greater.
+func compareVersions(p1, p2 *Package) int {
+	if p1.versionSemVer == nil || p2.versionSemVer == nil {
+		return strings.Compare(p1.Version, p2.Version)
+	}
+	return p1.versionSemVer.Compare(p2.versionSemVer)
 }
 
-// Join returns a set of packages that combines both sets.
+// Join returns a set of packages that combines both sets. Packages in the second set with
+// the same name and version as a package in the first set are shadowed by it, and not included.
 func (p1 Packages) Join(p2 Packages) Packages {
-	// TODO: Avoid duplications?
-	return append(p1, p2...)
+	joined, _ := p1.JoinShadowed(p2)
+	return joined
+}
+
+// JoinShadowed is like Join, but it also returns the packages of the second set that have been
+// shadowed by packages of the first set.
+func (p1 Packages) JoinShadowed(p2 Packages) (joined Packages, shadowed Packages) {
+	found := make(map[packageKey]struct{}, len(p1))
+	for _, p := range p1 {
+		found[keyOf(p)] = struct{}{}
+	}
+
+	joined = append(joined, p1...)
+	for _, p := range p2 {
+		key := keyOf(p)
+		if _, ok := found[key]; ok {
+			shadowed = append(shadowed, p)
+			continue
+		}
+		found[key] = struct{}{}
+		joined = append(joined, p)
+	}
+	return joined, shadowed
+}
+
+// packageKey identifies a version of a package.
+type packageKey struct {
+	name    string
+	version string
+}
+
+func keyOf(p *Package) packageKey {
+	return packageKey{name: p.Name, version: p.Version}
 }
 
 // GetOptions can be used to pass options to Get.
@@ -50,8 +141,16 @@ type GetOptions struct {
 
 // FileSystemIndexer indexes packages from the filesystem.
 type FileSystemIndexer struct {
-	paths       []string
+	paths []string
+
+	// Mutex protecting the list of packages, that can be replaced when packages are reloaded.
+	mu          sync.RWMutex
 	packageList Packages
+	searchIndex *SearchIndex
+	version     uint64
+
+	// reloadMutex serializes partial reloads, so changes found concurrently are not lost.
+	reloadMutex sync.Mutex
 
 	// Label used for APM instrumentation.
 	label string
@@ -61,6 +160,18 @@ type FileSystemIndexer struct {
 
 	// Builder to access the files of a package in this indexer.
 	fsBuilder FileSystemBuilder
+
+	// Server for the content of the packages, if they are not served directly from the file system.
+	server packageServer
+
+	// Verifier for the signatures of the packages, if they have to be verified.
+	verifier *SignatureVerifier
+
+	// Signer for the packages without signature, if they have to be signed by the registry.
+	signer *PackageSigner
+
+	// Checksums of the packages that are archived when served.
+	digests *digestCache
 }
 
 // NewFileSystemIndexer creates a new FileSystemIndexer for the given paths.
@@ -85,6 +196,9 @@ func NewFileSystemIndexer(paths ...string) *FileSystemIndexer {
 			}
 			return true, nil
 		}
+		if strings.HasSuffix(path, lifecycleSuffix) {
+			return false, nil
+		}
 		// Unexpected file, return nil in order to continue processing sibling directories
 		// Fixes an annoying problem when the .DS_Store file is left behind and the package
 		// is not loading without any error information
@@ -99,6 +213,7 @@ func NewFileSystemIndexer(paths ...string) *FileSystemIndexer {
 		label:     "FileSystemIndexer",
 		walkerFn:  walkerFn,
 		fsBuilder: fsBuilder,
+		digests:   newDigestCache(),
 	}
 }
 
@@ -130,74 +245,250 @@ func NewZipFileSystemIndexer(paths ...string) *FileSystemIndexer {
 		label:     "ZipFileSystemIndexer",
 		walkerFn:  walkerFn,
 		fsBuilder: fsBuilder,
+		digests:   newDigestCache(),
+	}
+}
+
+// NewTarGzFileSystemIndexer creates a new indexer for packages archived as tar.gz in the given paths.
+func NewTarGzFileSystemIndexer(paths ...string) *FileSystemIndexer {
+	walkerFn := func(basePath, path string, info os.DirEntry) (bool, error) {
+		if info.IsDir() {
+			return false, nil
+		}
+		if !strings.HasSuffix(path, ".tar.gz") {
+			return false, nil
+		}
+
+		if !isTarGz(path) {
+			log.Printf("warning: tar.gz file cannot be opened as tar.gz: %s, ignoring", path)
+			return false, nil
+		}
+
+		return true, nil
+	}
+	fsBuilder := func(p *Package) (PackageFileSystem, error) {
+		return NewTarGzPackageFileSystem(p)
+	}
+	return &FileSystemIndexer{
+		paths:     paths,
+		label:     "TarGzFileSystemIndexer",
+		walkerFn:  walkerFn,
+		fsBuilder: fsBuilder,
+		digests:   newDigestCache(),
 	}
 }
 
+// SetArchiveCache sets the cache used to store the archives of the packages of this indexer.
+// It must be called before initializing the indexer.
+func (i *FileSystemIndexer) SetArchiveCache(cache *ArchiveCache) {
+	i.digests.archives = cache
+	if cache == nil {
+		i.server = nil
+		return
+	}
+	i.server = cache
+}
+
+// SetSignatureVerifier sets the verifier used to check the signatures of the packages of this
+// indexer. It must be called before initializing the indexer.
+func (i *FileSystemIndexer) SetSignatureVerifier(verifier *SignatureVerifier) {
+	i.verifier = verifier
+}
+
+// SetPackageSigner sets the signer used to sign the packages of this indexer that don't have a
+// signature. It must be called before initializing the indexer.
+func (i *FileSystemIndexer) SetPackageSigner(signer *PackageSigner) {
+	i.signer = signer
+}
+
 // Init initializes the indexer.
 func (i *FileSystemIndexer) Init(ctx context.Context) (err error) {
-	i.packageList, err = i.getPackagesFromFileSystem(ctx)
+	packageList, _, err := i.getPackagesFromFileSystem(ctx, loadOptions{})
 	if err != nil {
 		return errors.Wrapf(err, "reading packages from filesystem failed")
 	}
+	i.setPackages(packageList)
 	return nil
 }
 
+// Reload reads again all the packages in the paths of the indexer. Differently to Init,
+// packages that cannot be loaded are logged and skipped, the number of skipped packages
+// is returned.
+func (i *FileSystemIndexer) Reload(ctx context.Context) (failed int, err error) {
+	packageList, failed, err := i.getPackagesFromFileSystem(ctx, loadOptions{skipInvalid: true})
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading packages from filesystem failed")
+	}
+	i.setPackages(packageList)
+	return failed, nil
+}
+
 // Get returns a slice with packages.
 // Options can be used to filter the returned list of packages. When no options are passed
 // or they don't contain any filter, no filtering is done.
 // The list is stored in memory and on the second request directly served from memory.
-// This assumes changes to packages only happen on restart (unless development mode is enabled).
+// The list is only replaced when packages are reloaded, see Watch.
 // Caching the packages request many file reads every time this method is called.
 func (i *FileSystemIndexer) Get(ctx context.Context, opts *GetOptions) (Packages, error) {
+	i.mu.RLock()
+	packageList, searchIndex := i.packageList, i.searchIndex
+	i.mu.RUnlock()
+
 	if opts == nil {
-		return i.packageList, nil
+		return packageList, nil
 	}
 
 	if opts.Filter != nil {
-		return opts.Filter.Apply(ctx, i.packageList), nil
+		return opts.Filter.WithSearchIndexes(searchIndex).Apply(ctx, packageList), nil
+	}
+
+	return packageList, nil
+}
+
+// SearchIndex returns the search index of the packages currently loaded.
+func (i *FileSystemIndexer) SearchIndex() *SearchIndex {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.searchIndex
+}
+
+// Label returns the kind of indexer, used to identify it in logs and metrics.
+func (i *FileSystemIndexer) Label() string {
+	return i.label
+}
+
+// PackagesVersion returns a number that changes every time the list of packages is replaced.
+func (i *FileSystemIndexer) PackagesVersion() uint64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.version
+}
+
+func (i *FileSystemIndexer) packages() Packages {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.packageList
+}
+
+// setPackages replaces the list of packages, and builds its search index. The list must be
+// completely built before calling this method, so concurrent calls to Get never see a partial list.
+func (i *FileSystemIndexer) setPackages(packageList Packages) {
+	searchIndex := NewSearchIndex(packageList)
+
+	i.digests.retain(packageList)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.signer != nil {
+		i.signer.forget(removedPaths(i.packageList, packageList))
+	}
+	i.packageList = packageList
+	i.searchIndex = searchIndex
+	i.version++
+}
+
+// removedPaths returns the paths of the packages in the previous list that are not in the current one.
+func removedPaths(previous, current Packages) []string {
+	paths := make(map[string]struct{}, len(current))
+	for _, p := range current {
+		paths[p.BasePath] = struct{}{}
+	}
+	var removed []string
+	for _, p := range previous {
+		if _, found := paths[p.BasePath]; !found {
+			removed = append(removed, p.BasePath)
+		}
 	}
+	return removed
+}
+
+// loadOptions are the options used when loading packages from the file system.
+type loadOptions struct {
+	// Packages already loaded that can be reused instead of being read again, indexed by path.
+	reuse map[string]*Package
 
-	return i.packageList, nil
+	// If set, packages that cannot be loaded are logged and skipped, instead of failing.
+	skipInvalid bool
 }
 
-func (i *FileSystemIndexer) getPackagesFromFileSystem(ctx context.Context) (Packages, error) {
+// getPackagesFromFileSystem reads the packages found in the paths of the indexer. It also
+// returns the number of packages that were skipped because they couldn't be loaded.
+func (i *FileSystemIndexer) getPackagesFromFileSystem(ctx context.Context, opts loadOptions) (Packages, int, error) {
 	span, ctx := apm.StartSpan(ctx, "GetFromFileSystem", "app")
 	span.Context.SetLabel("indexer", i.label)
 	defer span.End()
+	defer prometheus.NewTimer(metrics.IndexerLoadDuration.WithLabelValues(i.label)).ObserveDuration()
 
-	type packageKey struct {
-		name    string
-		version string
-	}
 	packagesFound := make(map[packageKey]struct{})
 
 	var pList Packages
+	var failed int
 	for _, basePath := range i.paths {
 		packagePaths, err := i.getPackagePaths(basePath)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
-		log.Printf("Packages in %s:", basePath)
+		if opts.reuse == nil {
+			log.Printf("Packages in %s:", basePath)
+		}
 		for _, path := range packagePaths {
-			p, err := NewPackage(path, i.fsBuilder)
-			if err != nil {
-				return nil, errors.Wrapf(err, "loading package failed (path: %s)", path)
+			p, reused := opts.reuse[path]
+			if !reused {
+				p, err = NewPackage(path, i.fsBuilder)
+				if err != nil {
+					metrics.PackageValidationFailures.Inc()
+				}
+				if err != nil && opts.skipInvalid {
+					log.Printf("warning: loading package failed (path: %s), ignoring: %v", path, err)
+					failed++
+					continue
+				}
+				if err != nil {
+					return nil, 0, errors.Wrapf(err, "loading package failed (path: %s)", path)
+				}
+				p.server = i.server
+				p.digests = i.digests
+
+				if p.SignaturePath == "" && i.signer != nil {
+					p.SignaturePath = p.GetDownloadPath() + ".sig"
+					p.signer = i.signer
+				}
+
+				if !i.verifier.checkPackage(p, openLocalSignature(p)) {
+					continue
+				}
 			}
 
-			key := packageKey{name: p.Name, version: p.Version}
+			key := keyOf(p)
 			if _, found := packagesFound[key]; found {
-				log.Printf("%-20s\t%10s\t%s", p.Name+" (duplicated)", p.Version, p.BasePath)
+				if !reused {
+					log.Printf("%-20s\t%10s\t%s", p.Name+" (duplicated)", p.Version, p.BasePath)
+				}
 				continue
 			}
 
+			if !reused {
+				p.SHA256, err = localPackageDigest(p)
+				if err != nil && opts.skipInvalid {
+					log.Printf("warning: computing package checksum failed (path: %s), ignoring: %v", path, err)
+					failed++
+					continue
+				}
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+
 			packagesFound[key] = struct{}{}
 			pList = append(pList, p)
 
-			log.Printf("%-20s\t%10s\t%s", p.Name, p.Version, p.BasePath)
+			if !reused {
+				log.Printf("%-20s\t%10s\t%s", p.Name, p.Version, p.BasePath)
+			}
 		}
 	}
-	return pList, nil
+	return pList, failed, nil
 }
 
 // getPackagePaths returns list of available packages, one for each version.
@@ -241,6 +532,76 @@ type Filter struct {
 	KibanaVersion  *semver.Version
 	PackageName    string
 	PackageVersion string
+	PackageType    string
+
+	// Release is the minimum release level of the packages returned. If it is set, experimental
+	// packages are returned if it is experimental, regardless of the Experimental flag.
+	Release string
+
+	// Owner is the GitHub owner of the packages returned.
+	Owner string
+
+	// Owners restricts the packages returned to the ones owned by any of these GitHub owners,
+	// if it is not empty.
+	Owners []string
+
+	// DataStreamType and Input filter packages with data streams of the given type, and
+	// policy templates offering the given input type.
+	DataStreamType string
+	Input          string
+
+	// Query is a full-text query, only packages matching it are returned, with their score.
+	Query string
+
+	// Indexes used to score packages when there is a query, they must contain the packages
+	// filtered. If there are no indexes, an index is built for the packages being filtered.
+	searchIndexes []*SearchIndex
+}
+
+// WithSearchIndexes returns a copy of the filter that uses the given indexes to score packages.
+func (f *Filter) WithSearchIndexes(indexes ...*SearchIndex) *Filter {
+	if f == nil {
+		return nil
+	}
+	filter := *f
+	filter.searchIndexes = nil
+	for _, index := range indexes {
+		if index != nil {
+			filter.searchIndexes = append(filter.searchIndexes, index)
+		}
+	}
+	return &filter
+}
+
+// Key returns a string that identifies the filter, equivalent filters have the same key. It can
+// be used to cache the results of applying the filter.
+func (f *Filter) Key() string {
+	if f == nil {
+		return ""
+	}
+	kibanaVersion := ""
+	if f.KibanaVersion != nil {
+		kibanaVersion = f.KibanaVersion.String()
+	}
+	return fmt.Sprintf("all=%t,category=%q,experimental=%t,internal=%t,kibana=%q,name=%q,version=%q,type=%q,release=%q,owner=%q,owners=%q,data_stream.type=%q,input=%q,query=%t%q",
+		f.AllVersions, f.Category, f.Experimental, f.Internal, kibanaVersion, f.PackageName, f.PackageVersion,
+		f.PackageType, f.Release, f.Owner, f.Owners, f.DataStreamType, f.Input, f.Query != "", searchTerms(f.Query))
+}
+
+// scores returns the score of the packages matching the query of the filter.
+func (f *Filter) scores(packages Packages) map[*Package]float64 {
+	indexes := f.searchIndexes
+	if len(indexes) == 0 {
+		indexes = []*SearchIndex{NewSearchIndex(packages)}
+	}
+
+	scores := make(map[*Package]float64)
+	for _, index := range indexes {
+		for p, score := range index.Scores(f.Query) {
+			scores[p] = score
+		}
+	}
+	return scores
 }
 
 // Apply applies the filter to the list of packages, if the filter is nil, no filtering is done.
@@ -252,16 +613,51 @@ func (f *Filter) Apply(ctx context.Context, packages Packages) Packages {
 	span, ctx := apm.StartSpan(ctx, "FilterPackages", "app")
 	defer span.End()
 
+	var scores map[*Package]float64
+	if f.Query != "" {
+		scores = f.scores(packages)
+	}
+
 	// Checks that only the most recent version of an integration is added to the list
 	var packagesList Packages
 	for _, p := range packages {
+		if scores != nil {
+			if _, found := scores[p]; !found {
+				continue
+			}
+		}
+
 		// Skip internal packages by default
 		if p.Internal && !f.Internal {
 			continue
 		}
 
-		// Skip experimental packages if flag is not specified
-		if p.Release == ReleaseExperimental && !f.Experimental {
+		if f.Release != "" {
+			if !IsReleaseAtLeast(p.Release, f.Release) {
+				continue
+			}
+		} else if p.Release == ReleaseExperimental && !f.Experimental {
+			// Skip experimental packages if flag is not specified
+			continue
+		}
+
+		if f.PackageType != "" && f.PackageType != p.Type {
+			continue
+		}
+
+		if f.Owner != "" && (p.Owner == nil || f.Owner != p.Owner.Github) {
+			continue
+		}
+
+		if len(f.Owners) > 0 && (p.Owner == nil || !util.StringsContains(f.Owners, p.Owner.Github)) {
+			continue
+		}
+
+		if f.DataStreamType != "" && !p.HasDataStreamType(f.DataStreamType) {
+			continue
+		}
+
+		if f.Input != "" && !p.HasInput(f.Input) {
 			continue
 		}
 
@@ -279,6 +675,12 @@ func (f *Filter) Apply(ctx context.Context, packages Packages) Packages {
 			continue
 		}
 
+		// Yanked versions are only returned when they are explicitly requested, or when
+		// all versions are listed.
+		if p.Yanked && f.PackageVersion == "" && !f.AllVersions {
+			continue
+		}
+
 		addPackage := true
 		if !f.AllVersions {
 			// Check if the version exists and if it should be added or not.
@@ -304,6 +706,14 @@ func (f *Filter) Apply(ctx context.Context, packages Packages) Packages {
 		}
 	}
 
+	if scores != nil {
+		for i, p := range packagesList {
+			scored := *p
+			scored.Score = scores[p]
+			packagesList[i] = &scored
+		}
+	}
+
 	// Filter by category after selecting the newer packages.
 	packagesList = filterCategories(packagesList, f.Category)
 
@@ -20,7 +20,19 @@ var ReleaseTypes = map[string]interface{}{
 	ReleaseGa:           nil,
 }
 
+// releaseMaturity is used to sort releases, more mature releases have higher values.
+var releaseMaturity = map[string]int{
+	ReleaseExperimental: 0,
+	ReleaseBeta:         1,
+	ReleaseGa:           2,
+}
+
 func IsValidRelease(release string) bool {
 	_, exists := ReleaseTypes[release]
 	return exists
 }
+
+// IsReleaseAtLeast checks if a release is at least as mature as the minimum one.
+func IsReleaseAtLeast(release, minimum string) bool {
+	return releaseMaturity[release] >= releaseMaturity[minimum]
+}
@@ -40,3 +40,27 @@ func TestReleases(t *testing.T) {
 		})
 	}
 }
+
+var releaseAtLeastTests = []struct {
+	release string
+	minimum string
+	atLeast bool
+}{
+	{ReleaseExperimental, ReleaseExperimental, true},
+	{ReleaseExperimental, ReleaseBeta, false},
+	{ReleaseExperimental, ReleaseGa, false},
+	{ReleaseBeta, ReleaseExperimental, true},
+	{ReleaseBeta, ReleaseBeta, true},
+	{ReleaseBeta, ReleaseGa, false},
+	{ReleaseGa, ReleaseExperimental, true},
+	{ReleaseGa, ReleaseBeta, true},
+	{ReleaseGa, ReleaseGa, true},
+}
+
+func TestReleaseAtLeast(t *testing.T) {
+	for _, tt := range releaseAtLeastTests {
+		t.Run(tt.release+" >= "+tt.minimum, func(t *testing.T) {
+			assert.Equal(t, tt.atLeast, IsReleaseAtLeast(tt.release, tt.minimum))
+		})
+	}
+}
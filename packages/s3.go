@@ -0,0 +1,587 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/archiver"
+	"github.com/elastic/package-registry/metrics"
+)
+
+const (
+	// Size of the blocks read from objects when accessing files of packages. Small reads
+	// done by zip readers are served from these blocks.
+	s3BlockSize = 64 * 1024
+
+	// Timeout for requests done to read blocks of objects.
+	s3ReadTimeout = 30 * time.Second
+)
+
+// S3Indexer indexes zipped packages stored in a bucket of an S3-compatible object storage.
+// The content of these packages is served directly from the bucket.
+type S3Indexer struct {
+	client *s3.S3
+	bucket string
+	prefix string
+
+	// Verifier for the signatures of the packages, if they have to be verified.
+	verifier *SignatureVerifier
+
+	mu          sync.RWMutex
+	packageList Packages
+	searchIndex *SearchIndex
+	version     uint64
+
+	// objectVersions identifies the current version of the objects of the packages, by key,
+	// so checksums computed for previous versions are not used.
+	objectVersions map[string]string
+
+	// digests contains the checksums computed for packages without checksum object, by key.
+	digestsMu sync.Mutex
+	digests   map[string]cachedDigest
+}
+
+// NewS3Indexer creates a new S3Indexer for the zipped packages found in the bucket, under
+// the given prefix.
+func NewS3Indexer(client *s3.S3, bucket, prefix string) *S3Indexer {
+	return &S3Indexer{
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+		digests: make(map[string]cachedDigest),
+	}
+}
+
+// SetSignatureVerifier sets the verifier used to check the signatures of the packages of this
+// indexer. Verifying signatures requires reading complete packages. It must be called before
+// initializing the indexer.
+func (i *S3Indexer) SetSignatureVerifier(verifier *SignatureVerifier) {
+	i.verifier = verifier
+}
+
+// Init initializes the indexer.
+func (i *S3Indexer) Init(ctx context.Context) error {
+	packageList, objectVersions, err := i.getPackagesFromBucket(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "reading packages from bucket failed (bucket: %s, prefix: %s)", i.bucket, i.prefix)
+	}
+
+	searchIndex := NewSearchIndex(packageList)
+
+	i.digestsMu.Lock()
+	for key, cached := range i.digests {
+		if cached.key != objectVersions[key] {
+			delete(i.digests, key)
+		}
+	}
+	i.digestsMu.Unlock()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.packageList = packageList
+	i.searchIndex = searchIndex
+	i.objectVersions = objectVersions
+	i.version++
+	return nil
+}
+
+// Get returns a slice with packages.
+// Options can be used to filter the returned list of packages. When no options are passed
+// or they don't contain any filter, no filtering is done.
+// The list is stored in memory, it is only refreshed when the indexer is initialized again.
+func (i *S3Indexer) Get(ctx context.Context, opts *GetOptions) (Packages, error) {
+	i.mu.RLock()
+	packageList, searchIndex := i.packageList, i.searchIndex
+	i.mu.RUnlock()
+
+	if opts == nil {
+		return packageList, nil
+	}
+
+	if opts.Filter != nil {
+		return opts.Filter.WithSearchIndexes(searchIndex).Apply(ctx, packageList), nil
+	}
+
+	return packageList, nil
+}
+
+// SearchIndex returns the search index of the packages currently loaded.
+func (i *S3Indexer) SearchIndex() *SearchIndex {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.searchIndex
+}
+
+// Label returns the kind of indexer, used to identify it in logs and metrics.
+func (i *S3Indexer) Label() string {
+	return "S3Indexer"
+}
+
+// PackagesVersion returns a number that changes every time the list of packages is replaced.
+func (i *S3Indexer) PackagesVersion() uint64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.version
+}
+
+// getPackagesFromBucket reads the packages found in the bucket. It also returns the versions of
+// the objects of the packages, by key.
+func (i *S3Indexer) getPackagesFromBucket(ctx context.Context) (Packages, map[string]string, error) {
+	span, ctx := apm.StartSpan(ctx, "GetFromBucket", "app")
+	span.Context.SetLabel("indexer", "S3Indexer")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.IndexerLoadDuration.WithLabelValues("S3Indexer")).ObserveDuration()
+
+	objects := make(map[string]*s3.Object)
+	err := i.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(i.bucket),
+		Prefix: aws.String(i.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects[aws.StringValue(object.Key)] = object
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "listing objects failed")
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasSuffix(key, ".zip") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	packagesFound := make(map[packageKey]struct{})
+
+	log.Printf("Packages in s3://%s/%s:", i.bucket, i.prefix)
+	var pList Packages
+	objectVersions := make(map[string]string)
+	for _, key := range keys {
+		p, err := NewPackage(i.objectURL(key), i.fsBuilder(key, aws.Int64Value(objects[key].Size)))
+		if errors.Is(err, zip.ErrFormat) {
+			log.Printf("warning: object cannot be opened as zip: %s, ignoring: %v", key, err)
+			continue
+		}
+		if err != nil {
+			metrics.PackageValidationFailures.Inc()
+			return nil, nil, errors.Wrapf(err, "loading package failed (key: %s)", key)
+		}
+		p.server = i
+
+		// Signatures are looked for in the bucket, not in the local file system.
+		if _, found := objects[key+".sig"]; found {
+			p.SignaturePath = p.GetDownloadPath() + ".sig"
+		}
+		if !i.verifier.checkPackage(p, i.openSignature(ctx, key)) {
+			continue
+		}
+		if _, found := objects[key+lifecycleSuffix]; found {
+			err := i.loadLifecycle(ctx, p, key+lifecycleSuffix)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "loading package lifecycle failed (key: %s)", key)
+			}
+		}
+
+		pk := keyOf(p)
+		if _, found := packagesFound[pk]; found {
+			log.Printf("%-20s\t%10s\t%s", p.Name+" (duplicated)", p.Version, p.BasePath)
+			continue
+		}
+
+		// Checksums are read from objects published along with the packages if available,
+		// otherwise they are computed when they are needed for the first time, as this
+		// requires downloading the complete package.
+		if _, found := objects[key+".sha256"]; found {
+			p.SHA256, err = i.readChecksumObject(ctx, key+".sha256")
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "reading package checksum failed (key: %s)", key)
+			}
+		} else {
+			p.digests = i
+		}
+		objectVersions[key] = objectVersion(objects[key])
+		packagesFound[pk] = struct{}{}
+		pList = append(pList, p)
+
+		log.Printf("%-20s\t%10s\t%s", p.Name, p.Version, p.BasePath)
+	}
+	return pList, objectVersions, nil
+}
+
+// objectVersion builds a string that changes when the object changes.
+func objectVersion(object *s3.Object) string {
+	return fmt.Sprintf("%s\x00%d\x00%d", aws.StringValue(object.ETag), aws.Int64Value(object.Size), aws.TimeValue(object.LastModified).UnixNano())
+}
+
+// openSignature opens a package stored in the bucket, and its signature.
+func (i *S3Indexer) openSignature(ctx context.Context, key string) signatureOpener {
+	return func() (io.ReadCloser, io.ReadCloser, error) {
+		signed, err := i.getObject(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		signature, err := i.getObject(ctx, key+".sig")
+		if err != nil {
+			signed.Close()
+			return nil, nil, err
+		}
+		return signed, signature, nil
+	}
+}
+
+// loadLifecycle reads the lifecycle of a package from a lifecycle object of the bucket.
+func (i *S3Indexer) loadLifecycle(ctx context.Context, p *Package, key string) error {
+	body, err := i.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	l, err := readLifecycle(body)
+	if err != nil {
+		return err
+	}
+	p.setLifecycle(l)
+	return nil
+}
+
+// getObject returns the content of an object of the bucket.
+func (i *S3Indexer) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := i.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(i.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting object failed (key: %s)", key)
+	}
+	return object.Body, nil
+}
+
+// readChecksumObject reads a SHA-256 checksum from an object in the format used by sha256sum.
+func (i *S3Indexer) readChecksumObject(ctx context.Context, key string) (string, error) {
+	body, err := i.getObject(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	return readChecksum(body)
+}
+
+// digest returns the SHA-256 checksum of a package without checksum object, downloading it
+// the first time it is needed.
+func (i *S3Indexer) digest(p *Package) (string, error) {
+	key := i.objectKey(p)
+	if digest := i.cachedDigest(key); digest != "" {
+		metrics.CacheRequests.WithLabelValues("digest", metrics.CacheHit).Inc()
+		return digest, nil
+	}
+	metrics.CacheRequests.WithLabelValues("digest", metrics.CacheMiss).Inc()
+
+	i.mu.RLock()
+	version := i.objectVersions[key]
+	i.mu.RUnlock()
+
+	body, err := i.getObject(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, body)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading object failed (key: %s)", key)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	i.digestsMu.Lock()
+	i.digests[key] = cachedDigest{key: version, digest: digest}
+	i.digestsMu.Unlock()
+	return digest, nil
+}
+
+// knownDigest returns the checksum of a package without checksum object, only if it was
+// already computed.
+func (i *S3Indexer) knownDigest(p *Package) (string, error) {
+	return i.cachedDigest(i.objectKey(p)), nil
+}
+
+// cachedDigest returns the checksum computed for the current version of an object, if any.
+func (i *S3Indexer) cachedDigest(key string) string {
+	i.mu.RLock()
+	version := i.objectVersions[key]
+	i.mu.RUnlock()
+
+	i.digestsMu.Lock()
+	defer i.digestsMu.Unlock()
+	cached, found := i.digests[key]
+	if !found || cached.key != version {
+		return ""
+	}
+	return cached.digest
+}
+
+// objectURL returns the URL of an object of the bucket, used as base path of packages.
+func (i *S3Indexer) objectURL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", i.bucket, key)
+}
+
+// objectKey returns the key of the object in the bucket for the package.
+func (i *S3Indexer) objectKey(p *Package) string {
+	return strings.TrimPrefix(p.BasePath, fmt.Sprintf("s3://%s/", i.bucket))
+}
+
+func (i *S3Indexer) fsBuilder(key string, size int64) FileSystemBuilder {
+	return func(p *Package) (PackageFileSystem, error) {
+		reader := &s3ObjectReader{
+			client: i.client,
+			bucket: i.bucket,
+			key:    key,
+			size:   size,
+		}
+		zipReader, err := zip.NewReader(reader, size)
+		if err != nil {
+			return nil, err
+		}
+		return newZipPackageFileSystem(zipReader, nil, p.BasePath)
+	}
+}
+
+func (i *S3Indexer) servePackage(w http.ResponseWriter, r *http.Request, p *Package) {
+	w.Header().Set("Content-Type", "application/gzip")
+	i.serveObject(w, r, i.objectKey(p))
+}
+
+func (i *S3Indexer) servePackageTarGz(w http.ResponseWriter, r *http.Request, p *Package) {
+	head, ok := i.headObject(w, r, i.objectKey(p))
+	if !ok {
+		return
+	}
+
+	// Zip archives are converted in temporary files, so tar.gz archives are served with
+	// the same support for range and conditional requests as the objects of the bucket.
+	w.Header().Set("Content-Type", "application/gzip")
+	servePackageConverted(w, r, p, archiver.FormatTarGz, aws.TimeValue(head.LastModified))
+}
+
+func (i *S3Indexer) serveSignature(w http.ResponseWriter, r *http.Request, p *Package) {
+	if p.SignaturePath == "" {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+	i.serveObject(w, r, i.objectKey(p)+".sig")
+}
+
+func (i *S3Indexer) serveFile(w http.ResponseWriter, r *http.Request, p *Package, name string) {
+	serveFileFromFileSystem(w, r, p, name)
+}
+
+// serveObject serves an object of the bucket. Range and conditional requests are supported.
+func (i *S3Indexer) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	head, ok := i.headObject(w, r, key)
+	if !ok {
+		return
+	}
+
+	f := &s3ObjectSeeker{
+		ctx:    r.Context(),
+		client: i.client,
+		bucket: i.bucket,
+		key:    key,
+		size:   aws.Int64Value(head.ContentLength),
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, path.Base(key), aws.TimeValue(head.LastModified), f)
+}
+
+// headObject gets the metadata of an object of the bucket. If it fails, an error response is
+// written and false is returned.
+func (i *S3Indexer) headObject(w http.ResponseWriter, r *http.Request, key string) (*s3.HeadObjectOutput, bool) {
+	head, err := i.client.HeadObjectWithContext(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(i.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("getting object from bucket failed (bucket: %s, key: %s): %v", i.bucket, key, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return nil, false
+	}
+	return head, true
+}
+
+func isS3NotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound
+}
+
+// s3ObjectReader reads ranges of an object in a bucket. Data is requested in blocks that
+// are kept in memory, so the small reads done by zip readers don't need a request each.
+type s3ObjectReader struct {
+	client *s3.S3
+	bucket string
+	key    string
+	size   int64
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (r *s3ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) && off < r.size {
+		block, err := r.block(off / s3BlockSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off%s3BlockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *s3ObjectReader) block(n int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if block, found := r.blocks[n]; found {
+		return block, nil
+	}
+
+	start := n * s3BlockSize
+	end := start + s3BlockSize
+	if end > r.size {
+		end = r.size
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3ReadTimeout)
+	defer cancel()
+	resp, err := r.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading object failed (bucket: %s, key: %s)", r.bucket, r.key)
+	}
+	defer resp.Body.Close()
+
+	block := make([]byte, end-start)
+	_, err = io.ReadFull(resp.Body, block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading object failed (bucket: %s, key: %s)", r.bucket, r.key)
+	}
+
+	if r.blocks == nil {
+		r.blocks = make(map[int64][]byte)
+	}
+	r.blocks[n] = block
+	return block, nil
+}
+
+// s3ObjectSeeker reads an object sequentially from the current offset, so complete objects
+// or ranges of them are served with a single request.
+type s3ObjectSeeker struct {
+	ctx    context.Context
+	client *s3.S3
+	bucket string
+	key    string
+	size   int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read implements the io.Reader interface.
+func (s *s3ObjectSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	if s.body == nil {
+		resp, err := s.client.GetObjectWithContext(s.ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", s.offset)),
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "reading object failed (bucket: %s, key: %s)", s.bucket, s.key)
+		}
+		s.body = resp.Body
+	}
+
+	n, err := s.body.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+// Seek implements the io.Seeker interface. The object is requested again on the next read
+// if the offset changes.
+func (s *s3ObjectSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != s.offset {
+		s.Close()
+		s.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current request to the object, if any.
+func (s *s3ObjectSeeker) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	err := s.body.Close()
+	s.body = nil
+	return err
+}
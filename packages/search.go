@@ -0,0 +1,131 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Weights of the fields of packages when ranking them for full-text queries.
+const (
+	searchWeightName                      = 10
+	searchWeightTitle                     = 8
+	searchWeightPolicyTemplateTitle       = 4
+	searchWeightDataStreamTitle           = 3
+	searchWeightDescription               = 2
+	searchWeightPolicyTemplateDescription = 1
+
+	// Factor applied to the weight of terms that only match the beginning of a term of
+	// the package, so exact matches are ranked higher.
+	searchPrefixFactor = 0.5
+)
+
+// SearchIndex is an inverted index of the text fields of a list of packages, used to rank
+// them for full-text queries.
+type SearchIndex struct {
+	// Sorted list of indexed terms, to look for terms by prefix.
+	terms []string
+
+	// Weight of each term in each package.
+	postings map[string]map[*Package]float64
+}
+
+// NewSearchIndex builds the search index for a list of packages.
+func NewSearchIndex(packages Packages) *SearchIndex {
+	index := SearchIndex{
+		postings: make(map[string]map[*Package]float64),
+	}
+	for _, p := range packages {
+		index.add(p, searchWeightName, p.Name)
+		if p.Title != nil {
+			index.add(p, searchWeightTitle, *p.Title)
+		}
+		index.add(p, searchWeightDescription, p.Description)
+		for _, t := range p.PolicyTemplates {
+			index.add(p, searchWeightPolicyTemplateTitle, t.Title)
+			index.add(p, searchWeightPolicyTemplateDescription, t.Description)
+		}
+		for _, d := range p.DataStreams {
+			index.add(p, searchWeightDataStreamTitle, d.Title)
+		}
+	}
+
+	for term := range index.postings {
+		index.terms = append(index.terms, term)
+	}
+	sort.Strings(index.terms)
+	return &index
+}
+
+// add adds the terms of a field of a package to the index. Terms repeated in the same field
+// are only counted once.
+func (i *SearchIndex) add(p *Package, weight float64, text string) {
+	seen := make(map[string]bool)
+	for _, term := range searchTerms(text) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		postings, found := i.postings[term]
+		if !found {
+			postings = make(map[*Package]float64)
+			i.postings[term] = postings
+		}
+		postings[p] += weight
+	}
+}
+
+// Scores returns the score of the packages matching the query. Packages match if they
+// contain all the terms of the query, or terms starting with them.
+func (i *SearchIndex) Scores(query string) map[*Package]float64 {
+	var scores map[*Package]float64
+	for n, term := range searchTerms(query) {
+		termScores := i.termScores(term)
+		if n == 0 {
+			scores = termScores
+			continue
+		}
+		for p, score := range scores {
+			termScore, found := termScores[p]
+			if !found {
+				delete(scores, p)
+				continue
+			}
+			scores[p] = score + termScore
+		}
+	}
+	return scores
+}
+
+// termScores returns the score of the packages containing the term, or terms starting with it.
+func (i *SearchIndex) termScores(term string) map[*Package]float64 {
+	scores := make(map[*Package]float64)
+	for n := sort.SearchStrings(i.terms, term); n < len(i.terms); n++ {
+		indexed := i.terms[n]
+		if !strings.HasPrefix(indexed, term) {
+			break
+		}
+		factor := 1.0
+		if indexed != term {
+			factor = searchPrefixFactor
+		}
+		for p, weight := range i.postings[indexed] {
+			if score := weight * factor; score > scores[p] {
+				scores[p] = score
+			}
+		}
+	}
+	return scores
+}
+
+// searchTerms splits a text in lowercase terms formed by letters and numbers.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
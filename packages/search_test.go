@@ -0,0 +1,75 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchIndex(t *testing.T) {
+	title := func(s string) *string { return &s }
+	nginx := &Package{BasePackage: BasePackage{
+		Name:        "nginx",
+		Title:       title("Nginx"),
+		Description: "Collect logs and metrics from Nginx HTTP servers.",
+	}}
+	apache := &Package{
+		BasePackage: BasePackage{
+			Name:        "apache",
+			Title:       title("Apache HTTP Server"),
+			Description: "Collect logs and metrics from Apache servers.",
+		},
+		DataStreams: []*DataStream{{Title: "Apache access logs"}},
+	}
+	proxy := &Package{
+		BasePackage: BasePackage{
+			Name:        "proxy",
+			Title:       title("Reverse proxy"),
+			Description: "Collect logs from reverse proxies, as nginx.",
+		},
+		PolicyTemplates: []PolicyTemplate{
+			{Title: "Nginx-compatible proxies", Description: "Proxies compatible with nginx logs."},
+		},
+	}
+	index := NewSearchIndex(Packages{nginx, apache, proxy})
+
+	cases := []struct {
+		query    string
+		expected map[*Package]float64
+	}{
+		{
+			query: "nginx",
+			expected: map[*Package]float64{
+				nginx: searchWeightName + searchWeightTitle + searchWeightDescription,
+				proxy: searchWeightDescription + searchWeightPolicyTemplateTitle + searchWeightPolicyTemplateDescription,
+			},
+		},
+		{
+			query: "Apache logs",
+			expected: map[*Package]float64{
+				apache: searchWeightName + searchWeightTitle + searchWeightDescription + searchWeightDataStreamTitle +
+					searchWeightDescription + searchWeightDataStreamTitle,
+			},
+		},
+		{
+			query: "prox",
+			expected: map[*Package]float64{
+				proxy: searchPrefixFactor * (searchWeightName + searchWeightTitle),
+			},
+		},
+		{
+			query:    "nginx apache",
+			expected: map[*Package]float64{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			assert.Equal(t, c.expected, index.Scores(c.query))
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SignatureVerifier verifies the signatures of packages with the keys of an OpenPGP keyring.
+type SignatureVerifier struct {
+	keyring openpgp.EntityList
+
+	// If required, packages without a valid signature are not indexed.
+	required bool
+}
+
+// NewSignatureVerifier creates a verifier for the keys in the given keyring, that can be armored
+// or binary.
+func NewSignatureVerifier(keyring io.Reader, required bool) (*SignatureVerifier, error) {
+	entities, err := readKeyring(keyring)
+	if err != nil {
+		return nil, err
+	}
+	return &SignatureVerifier{
+		keyring:  entities,
+		required: required,
+	}, nil
+}
+
+// readKeyring reads an OpenPGP keyring, armored or binary.
+func readKeyring(keyring io.Reader) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadAll(keyring)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading keyring failed")
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing keyring failed")
+	}
+	if len(entities) == 0 {
+		return nil, errors.New("keyring doesn't contain any key")
+	}
+	return entities, nil
+}
+
+// NewSignatureVerifierFromFile creates a verifier for the keys in the keyring file.
+func NewSignatureVerifierFromFile(path string, required bool) (*SignatureVerifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening keyring failed")
+	}
+	defer f.Close()
+	return NewSignatureVerifier(f, required)
+}
+
+// WithSigner returns a verifier that also accepts the signatures of the signer. If the verifier
+// is nil, the returned verifier only accepts the signatures of the signer, and doesn't require
+// signatures.
+func (v *SignatureVerifier) WithSigner(signer *PackageSigner) *SignatureVerifier {
+	if v == nil {
+		return &SignatureVerifier{keyring: openpgp.EntityList{signer.entity}}
+	}
+	for _, entity := range v.keyring {
+		if entity.PrimaryKey.Fingerprint == signer.entity.PrimaryKey.Fingerprint {
+			return v
+		}
+	}
+	keyring := append(openpgp.EntityList{}, v.keyring...)
+	return &SignatureVerifier{
+		keyring:  append(keyring, signer.entity),
+		required: v.required,
+	}
+}
+
+// Verify checks that the signature is a valid signature of the signed content, done with
+// any of the keys of the keyring. Signatures can be armored or binary.
+func (v *SignatureVerifier) Verify(signed io.Reader, signature io.Reader) error {
+	content, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return errors.Wrap(err, "reading signature failed")
+	}
+
+	var signer *openpgp.Entity
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN")) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(v.keyring, signed, bytes.NewReader(content))
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(v.keyring, signed, bytes.NewReader(content))
+	}
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		return errors.New("signer not found in keyring")
+	}
+	return nil
+}
+
+// PublicKeyInfo describes a public key used to verify signatures.
+type PublicKeyInfo struct {
+	Fingerprint string     `json:"fingerprint"`
+	KeyID       string     `json:"key_id"`
+	Algorithm   string     `json:"algorithm"`
+	Bits        int        `json:"bits,omitempty"`
+	UserIDs     []string   `json:"user_ids,omitempty"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// PublicKeys returns the description of the public keys of the keyring.
+func (v *SignatureVerifier) PublicKeys() []PublicKeyInfo {
+	var keys []PublicKeyInfo
+	for _, entity := range v.keyring {
+		key := entity.PrimaryKey
+		info := PublicKeyInfo{
+			Fingerprint: strings.ToUpper(hex.EncodeToString(key.Fingerprint[:])),
+			KeyID:       key.KeyIdString(),
+			Algorithm:   publicKeyAlgorithmName(key.PubKeyAlgo),
+			Created:     key.CreationTime.UTC(),
+		}
+		if bits, err := key.BitLength(); err == nil {
+			info.Bits = int(bits)
+		}
+
+		var names []string
+		for name := range entity.Identities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			info.UserIDs = append(info.UserIDs, name)
+			selfSignature := entity.Identities[name].SelfSignature
+			if selfSignature != nil && selfSignature.KeyLifetimeSecs != nil && *selfSignature.KeyLifetimeSecs > 0 {
+				expires := info.Created.Add(time.Duration(*selfSignature.KeyLifetimeSecs) * time.Second)
+				info.Expires = &expires
+			}
+		}
+		keys = append(keys, info)
+	}
+	return keys
+}
+
+// WriteArmoredPublicKeys writes the public keys of the keyring, armored.
+func (v *SignatureVerifier) WriteArmoredPublicKeys(w io.Writer) error {
+	armored, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	for _, entity := range v.keyring {
+		err := entity.Serialize(armored)
+		if err != nil {
+			return errors.Wrapf(err, "serializing public key failed (key id: %s)", entity.PrimaryKey.KeyIdString())
+		}
+	}
+	err = armored.Close()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func publicKeyAlgorithmName(algorithm packet.PublicKeyAlgorithm) string {
+	switch algorithm {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoRSAEncryptOnly:
+		return "RSA"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	default:
+		return fmt.Sprintf("unknown (%d)", algorithm)
+	}
+}
+
+// signatureOpener opens the signed artifact of a package and its signature.
+type signatureOpener func() (signed io.ReadCloser, signature io.ReadCloser, err error)
+
+// checkPackage verifies the signature of the package, and sets its signature status. It returns
+// false if the package should not be indexed because signatures are required.
+func (v *SignatureVerifier) checkPackage(p *Package, open signatureOpener) bool {
+	if v == nil {
+		return true
+	}
+
+	if p.signer != nil {
+		// Signed by the registry. Signatures are built when requested, so there is nothing to
+		// verify yet, and the verification status is not reported.
+		return true
+	}
+
+	verified := false
+	if p.SignaturePath != "" {
+		err := v.verifyPackage(open)
+		if err != nil {
+			log.Printf("warning: signature of package %s-%s is not valid (path: %s): %v", p.Name, p.Version, p.BasePath, err)
+		} else {
+			verified = true
+		}
+	}
+	p.SignatureVerified = &verified
+
+	if !verified && v.required {
+		log.Printf("warning: package %s-%s doesn't have a valid signature, ignoring (path: %s)", p.Name, p.Version, p.BasePath)
+		return false
+	}
+	return true
+}
+
+func (v *SignatureVerifier) verifyPackage(open signatureOpener) error {
+	signed, signature, err := open()
+	if err != nil {
+		return err
+	}
+	defer signed.Close()
+	defer signature.Close()
+
+	return v.Verify(signed, signature)
+}
+
+// openLocalSignature opens a package archived in the local file system, and its signature.
+func openLocalSignature(p *Package) signatureOpener {
+	return func() (io.ReadCloser, io.ReadCloser, error) {
+		info, err := os.Stat(p.BasePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.IsDir() {
+			return nil, nil, errors.New("signatures of extracted packages cannot be verified")
+		}
+
+		signed, err := os.Open(p.BasePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		signature, err := os.Open(p.BasePath + ".sig")
+		if err != nil {
+			signed.Close()
+			return nil, nil, err
+		}
+		return signed, signature, nil
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKeyringPath   = "../testdata/signatures/public-key.asc"
+	testSignedStorage = "../testdata/signed-storage"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	verifier, err := NewSignatureVerifierFromFile(testKeyringPath, false)
+	require.NoError(t, err)
+
+	cases := []struct {
+		path  string
+		valid bool
+	}{
+		{"multiversion-1.0.3.zip", true},
+		{"multiversion-1.0.4.zip", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			signed, err := os.Open(testSignedStorage + "/" + c.path)
+			require.NoError(t, err)
+			defer signed.Close()
+			signature, err := os.Open(testSignedStorage + "/" + c.path + ".sig")
+			require.NoError(t, err)
+			defer signature.Close()
+
+			err = verifier.Verify(signed, signature)
+			if c.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	_, err = NewSignatureVerifier(strings.NewReader("not a keyring"), false)
+	assert.Error(t, err)
+}
+
+func TestFileSystemIndexerSignatures(t *testing.T) {
+	cases := []struct {
+		title    string
+		required bool
+		expected map[string]bool
+	}{
+		{
+			title:    "signatures verified",
+			required: false,
+			expected: map[string]bool{
+				"1.0.3": true,
+				"1.0.4": false,
+				"1.1.0": false,
+			},
+		},
+		{
+			title:    "signatures required",
+			required: true,
+			expected: map[string]bool{
+				"1.0.3": true,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			verifier, err := NewSignatureVerifierFromFile(testKeyringPath, c.required)
+			require.NoError(t, err)
+
+			indexer := NewZipFileSystemIndexer(testSignedStorage)
+			indexer.SetSignatureVerifier(verifier)
+			err = indexer.Init(context.Background())
+			require.NoError(t, err)
+
+			packages, err := indexer.Get(context.Background(), nil)
+			require.NoError(t, err)
+
+			found := make(map[string]bool)
+			for _, p := range packages {
+				require.NotNil(t, p.SignatureVerified, p.Version)
+				found[p.Version] = *p.SignatureVerified
+			}
+			assert.Equal(t, c.expected, found)
+		})
+	}
+
+	// Signature status is not set if signatures are not verified.
+	indexer := NewZipFileSystemIndexer(testSignedStorage)
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+	for _, p := range packages {
+		assert.Nil(t, p.SignatureVerified)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// PackageSigner signs the artifacts of packages that don't have a signature, with a private key
+// of the registry. Signatures are built when they are requested for the first time, and they
+// are kept in memory for the path of the package and a fingerprint of its files, so they are
+// reused while the package doesn't change.
+type PackageSigner struct {
+	entity *openpgp.Entity
+
+	mu sync.Mutex
+
+	// signatures contains the last signature built for each package path.
+	signatures map[string]signature
+}
+
+type signature struct {
+	key     string
+	content []byte
+	created time.Time
+}
+
+// NewPackageSigner creates a signer with the private key in the given OpenPGP keyring, armored
+// or binary. If the key is encrypted, it is decrypted with the passphrase.
+func NewPackageSigner(key io.Reader, passphrase string) (*PackageSigner, error) {
+	keyring, err := readKeyring(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) != 1 {
+		return nil, errors.Errorf("keyring must contain exactly one key, found %d", len(keyring))
+	}
+	entity := keyring[0]
+	if entity.PrivateKey == nil {
+		return nil, errors.New("keyring doesn't contain a private key")
+	}
+
+	if entity.PrivateKey.Encrypted {
+		err := entity.PrivateKey.Decrypt([]byte(passphrase))
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypting private key failed")
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			err := subkey.PrivateKey.Decrypt([]byte(passphrase))
+			if err != nil {
+				return nil, errors.Wrap(err, "decrypting private subkey failed")
+			}
+		}
+	}
+
+	return &PackageSigner{
+		entity:     entity,
+		signatures: make(map[string]signature),
+	}, nil
+}
+
+// NewPackageSignerFromFile creates a signer with the private key in the given file.
+func NewPackageSignerFromFile(path string, passphrase string) (*PackageSigner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening private key failed")
+	}
+	defer f.Close()
+	return NewPackageSigner(f, passphrase)
+}
+
+// serveSignature serves the signature of the zip artifact of a package available in the local
+// file system, signing it if needed.
+func (s *PackageSigner) serveSignature(w http.ResponseWriter, r *http.Request, p *Package) {
+	sig, err := s.signature(p)
+	if err != nil {
+		log.Printf("signing package '%s' failed: %v", p.BasePath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, path.Base(p.SignaturePath), sig.created, bytes.NewReader(sig.content))
+}
+
+// signature returns the signature of the package, from the cache if it was already signed and
+// its files didn't change.
+func (s *PackageSigner) signature(p *Package) (signature, error) {
+	key, err := artifactKey(p.BasePath)
+	if err != nil {
+		return signature{}, errors.Wrap(err, "fingerprinting package failed")
+	}
+	s.mu.Lock()
+	sig, found := s.signatures[p.BasePath]
+	s.mu.Unlock()
+	if found && sig.key == key {
+		return sig, nil
+	}
+
+	var buf bytes.Buffer
+	err = s.sign(&buf, p)
+	if err != nil {
+		return signature{}, err
+	}
+	sig = signature{
+		key:     key,
+		content: buf.Bytes(),
+		created: time.Now(),
+	}
+
+	s.mu.Lock()
+	if cached, found := s.signatures[p.BasePath]; found && cached.key == key {
+		sig = cached
+	} else {
+		s.signatures[p.BasePath] = sig
+	}
+	s.mu.Unlock()
+	return sig, nil
+}
+
+// forget removes the signatures of the packages in the given paths, so they are not kept in
+// memory once the packages are removed.
+func (s *PackageSigner) forget(paths []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range paths {
+		delete(s.signatures, path)
+	}
+}
+
+// sign writes an armored detached signature of the zip artifact of the package.
+func (s *PackageSigner) sign(w io.Writer, p *Package) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeLocalArtifact(writer, p))
+	}()
+	defer reader.Close()
+
+	err := openpgp.ArmoredDetachSign(w, s.entity, reader, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/util"
+)
+
+const testPrivateKeyPath = "../testdata/signatures/private-key.asc"
+
+func TestPackageSigner(t *testing.T) {
+	signer, err := NewPackageSignerFromFile(testPrivateKeyPath, "")
+	require.NoError(t, err)
+	verifier, err := NewSignatureVerifierFromFile(testKeyringPath, false)
+	require.NoError(t, err)
+
+	packagesPath := t.TempDir()
+	require.NoError(t, util.CopyDir("../testdata/package/example/1.0.0", filepath.Join(packagesPath, "example", "1.0.0")))
+
+	indexer := NewFileSystemIndexer(packagesPath)
+	indexer.SetPackageSigner(signer)
+	indexer.SetSignatureVerifier(verifier)
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	p := packages[0]
+	assert.Equal(t, "/epr/example/example-1.0.0.zip.sig", p.SignaturePath)
+	assert.Nil(t, p.SignatureVerified, "signatures built by the registry are not verified when indexing")
+
+	serve := func(handler func(w http.ResponseWriter, r *http.Request, p *Package)) []byte {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil), p)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.Bytes()
+	}
+
+	archive := serve(ServePackage)
+	signature := serve(ServeSignature)
+	err = verifier.Verify(bytes.NewReader(archive), bytes.NewReader(signature))
+	assert.NoError(t, err)
+
+	// Signatures are reused.
+	assert.Equal(t, signature, serve(ServeSignature))
+
+	// Packages are signed again when their content changes.
+	err = ioutil.WriteFile(filepath.Join(p.BasePath, "docs", "README.md"), []byte("# Changed\n"), 0644)
+	require.NoError(t, err)
+	archive = serve(ServePackage)
+	changedSignature := serve(ServeSignature)
+	assert.NotEqual(t, signature, changedSignature)
+	err = verifier.Verify(bytes.NewReader(archive), bytes.NewReader(changedSignature))
+	assert.NoError(t, err)
+
+	// Signatures of removed packages are forgotten.
+	indexer.setPackages(nil)
+	assert.Empty(t, signer.signatures)
+}
+
+func TestPackageSignerArchivedPackages(t *testing.T) {
+	signer, err := NewPackageSignerFromFile(testPrivateKeyPath, "")
+	require.NoError(t, err)
+
+	indexer := NewZipFileSystemIndexer(testSignedStorage)
+	indexer.SetPackageSigner(signer)
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, packages, 3)
+	for _, p := range packages {
+		assert.NotEmpty(t, p.SignaturePath, p.Version)
+
+		// Only packages without their own signature are signed by the registry.
+		signedByRegistry := p.signer != nil
+		assert.Equal(t, p.Version == "1.1.0", signedByRegistry, p.Version)
+	}
+}
+
+func TestPackageSignerPublicKey(t *testing.T) {
+	_, err := NewPackageSignerFromFile(testKeyringPath, "")
+	assert.Error(t, err, "a public key cannot be used to sign")
+
+	signer, err := NewPackageSignerFromFile(testPrivateKeyPath, "")
+	require.NoError(t, err)
+	verifier, err := NewSignatureVerifierFromFile(testKeyringPath, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, verifier.PublicKeys(), (*SignatureVerifier)(nil).WithSigner(signer).PublicKeys())
+	assert.Equal(t, verifier.PublicKeys(), verifier.WithSigner(signer).PublicKeys())
+}
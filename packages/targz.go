@@ -0,0 +1,221 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/archiver"
+)
+
+// TarGzPackageFileSystem provides utils to access files in a package archived as tar.gz.
+// These archives cannot be read at random positions, so files are found reading the archive
+// from the beginning. Reading files in the order they are archived only needs to read the
+// archive once.
+type TarGzPackageFileSystem struct {
+	path string
+	root string
+
+	// Headers of the entries of the archive, in the order they are archived, and the
+	// position of each one by name.
+	headers []*tar.Header
+	index   map[string]int
+
+	// Current position reading the archive.
+	mu     sync.Mutex
+	file   *os.File
+	reader *tar.Reader
+	next   int
+}
+
+func NewTarGzPackageFileSystem(p *Package) (*TarGzPackageFileSystem, error) {
+	fs := &TarGzPackageFileSystem{
+		path:  p.BasePath,
+		index: make(map[string]int),
+	}
+	err := fs.rewind()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for {
+		header, err := fs.reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fs.Close()
+			return nil, errors.Wrapf(err, "reading tar.gz archive failed (path: %s)", p.BasePath)
+		}
+		name := path.Clean(header.Name)
+		fs.index[name] = len(fs.headers)
+		fs.headers = append(fs.headers, header)
+
+		parts := strings.Split(name, "/")
+		if !found && len(parts) == 2 && parts[1] == "manifest.yml" {
+			fs.root = parts[0]
+			found = true
+		}
+	}
+	fs.next = len(fs.headers)
+	if !found {
+		fs.Close()
+		return nil, fmt.Errorf("failed to determine root directory in package (path: %s)", p.BasePath)
+	}
+	return fs, nil
+}
+
+func (fs *TarGzPackageFileSystem) Stat(name string) (os.FileInfo, error) {
+	header, found := fs.header(name)
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return header.FileInfo(), nil
+}
+
+// Open reads the file from the archive, and returns a file with its content.
+func (fs *TarGzPackageFileSystem) Open(name string) (PackageFile, error) {
+	header, found := fs.header(name)
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if header.Typeflag == tar.TypeDir {
+		return &tarGzFile{Reader: bytes.NewReader(nil)}, nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	position := fs.index[path.Clean(header.Name)]
+	if position < fs.next {
+		err := fs.rewind()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for fs.next <= position {
+		_, err := fs.reader.Next()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading tar.gz archive failed (path: %s)", fs.path)
+		}
+		fs.next++
+	}
+	content, err := ioutil.ReadAll(fs.reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading file from tar.gz archive failed (path: %s, file: %s)", fs.path, name)
+	}
+	return &tarGzFile{Reader: bytes.NewReader(content)}, nil
+}
+
+func (fs *TarGzPackageFileSystem) Glob(pattern string) (matches []string, err error) {
+	pattern = path.Join(fs.root, filepath.ToSlash(pattern))
+	for _, header := range fs.headers {
+		name := path.Clean(header.Name)
+		match, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matches = append(matches, strings.TrimPrefix(name, fs.root+"/"))
+		}
+	}
+	return
+}
+
+func (fs *TarGzPackageFileSystem) archiveFiles() []archiver.File {
+	var files []archiver.File
+	for _, header := range fs.headers {
+		name := path.Clean(header.Name)
+		if !strings.HasPrefix(name, fs.root+"/") {
+			continue
+		}
+		name = strings.TrimPrefix(name, fs.root+"/")
+		files = append(files, archiver.File{
+			Name: name,
+			Info: header.FileInfo(),
+			Open: func() (io.ReadCloser, error) {
+				return fs.Open(name)
+			},
+		})
+	}
+	return files
+}
+
+func (fs *TarGzPackageFileSystem) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+func (fs *TarGzPackageFileSystem) header(name string) (*tar.Header, bool) {
+	i, found := fs.index[path.Join(fs.root, filepath.ToSlash(name))]
+	if !found {
+		return nil, false
+	}
+	return fs.headers[i], true
+}
+
+// rewind opens the archive again to read it from the beginning.
+func (fs *TarGzPackageFileSystem) rewind() error {
+	if fs.file != nil {
+		fs.file.Close()
+		fs.file = nil
+	}
+
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return err
+	}
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "reading gzip stream failed (path: %s)", fs.path)
+	}
+	fs.file = f
+	fs.reader = tar.NewReader(gzipReader)
+	fs.next = 0
+	return nil
+}
+
+// tarGzFile is a file read from a tar.gz archive.
+type tarGzFile struct {
+	*bytes.Reader
+}
+
+func (f *tarGzFile) Close() error { return nil }
+
+// isTarGz checks if a file is a valid tar.gz archive, reading its first entry.
+func isTarGz(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(gzipReader).Next()
+	return err == nil
+}
@@ -0,0 +1,191 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/joeshaw/multierror"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/metrics"
+)
+
+// ErrPackageExists is returned when publishing a version of a package that is already available.
+var ErrPackageExists = errors.New("package already exists")
+
+// InvalidPackageError is returned when an uploaded package is not valid. It contains all the
+// problems found.
+type InvalidPackageError struct {
+	Problems []string
+}
+
+func (e *InvalidPackageError) Error() string {
+	return "invalid package: " + strings.Join(e.Problems, "; ")
+}
+
+// uploadedNamePattern matches the names of packages that can be uploaded, they are used to
+// build the paths of the uploaded files. It is the same pattern used in the paths of artifacts.
+var uploadedNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// UploadIndexer indexes zipped packages uploaded to the registry. Uploaded packages are stored
+// in a writable directory, and they are indexed as soon as they are published.
+type UploadIndexer struct {
+	*FileSystemIndexer
+
+	path string
+}
+
+// NewUploadIndexer creates an indexer for the packages uploaded to the given directory.
+func NewUploadIndexer(path string) *UploadIndexer {
+	indexer := NewZipFileSystemIndexer(path)
+	indexer.label = "UploadIndexer"
+	return &UploadIndexer{
+		FileSystemIndexer: indexer,
+		path:              path,
+	}
+}
+
+// StagedPackage is an uploaded package that has been validated, but is not indexed yet.
+type StagedPackage struct {
+	*Package
+
+	indexer *UploadIndexer
+	path    string
+}
+
+// StagePackage stores the zipped package read from r in the upload directory, and validates it
+// as packages are validated when indexed. The staged package is not indexed till it is published.
+func (i *UploadIndexer) StagePackage(r io.Reader) (*StagedPackage, error) {
+	err := os.MkdirAll(i.path, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating upload directory failed")
+	}
+
+	// Temporary files don't have the .zip extension, so they are never indexed.
+	f, err := ioutil.TempFile(i.path, ".upload-*.tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating upload file failed")
+	}
+	path := f.Name()
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, errors.Wrap(err, "storing uploaded package failed")
+	}
+
+	p, err := NewPackage(path, i.fsBuilder)
+	if err != nil {
+		metrics.PackageValidationFailures.Inc()
+		os.Remove(path)
+		return nil, &InvalidPackageError{Problems: validationProblems(err)}
+	}
+	// Name and version are used in the path of the published package, they are checked here
+	// even if validation is disabled.
+	var problems []string
+	if !uploadedNamePattern.MatchString(p.Name) {
+		problems = append(problems, "invalid package name: "+p.Name)
+	}
+	if _, err := semver.StrictNewVersion(p.Version); err != nil {
+		problems = append(problems, "invalid package version: "+p.Version)
+	}
+	if len(problems) > 0 {
+		os.Remove(path)
+		return nil, &InvalidPackageError{Problems: problems}
+	}
+	if i.verifier != nil && i.verifier.required && i.signer == nil {
+		os.Remove(path)
+		return nil, &InvalidPackageError{Problems: []string{"signatures are required, and uploaded packages are not signed"}}
+	}
+
+	return &StagedPackage{
+		Package: p,
+		indexer: i,
+		path:    path,
+	}, nil
+}
+
+// Publish moves the package to its final location in the upload directory, and indexes it. It
+// fails with ErrPackageExists if this version of the package was already uploaded. The staged
+// package is discarded if it cannot be published.
+func (s *StagedPackage) Publish(ctx context.Context) error {
+	dest := filepath.Clean(filepath.Join(s.indexer.path, s.Name+"-"+s.Version+".zip"))
+	if filepath.Dir(dest) != filepath.Clean(s.indexer.path) {
+		s.Discard()
+		return errors.Errorf("package path out of the upload directory (path: %s)", dest)
+	}
+	_, err := os.Stat(dest)
+	if err == nil {
+		s.Discard()
+		return ErrPackageExists
+	}
+	if !os.IsNotExist(err) {
+		s.Discard()
+		return err
+	}
+
+	err = os.Rename(s.path, dest)
+	if err != nil {
+		s.Discard()
+		return errors.Wrap(err, "moving uploaded package failed")
+	}
+
+	s.indexer.reload(ctx, []string{dest})
+	for _, p := range s.indexer.packages() {
+		if p.BasePath == dest {
+			s.Package = p
+			return nil
+		}
+	}
+
+	// Reasons are logged when reloading.
+	os.Remove(dest)
+	return errors.Errorf("package could not be indexed (path: %s)", dest)
+}
+
+// Discard removes the staged package.
+func (s *StagedPackage) Discard() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// validationProblems returns the list of problems found when loading a package. Validation
+// errors can be wrapped by other errors, as the ones returned when unpacking the manifest.
+func validationProblems(err error) []string {
+	for cause := err; cause != nil; {
+		if multiErr, ok := cause.(*multierror.MultiError); ok {
+			problems := make([]string, len(multiErr.Errors))
+			for i, err := range multiErr.Errors {
+				problems[i] = err.Error()
+			}
+			return problems
+		}
+
+		switch wrapper := cause.(type) {
+		case interface{ Reason() error }:
+			cause = wrapper.Reason()
+		case interface{ Cause() error }:
+			cause = wrapper.Cause()
+		case interface{ Unwrap() error }:
+			cause = wrapper.Unwrap()
+		default:
+			cause = nil
+		}
+	}
+	return []string{err.Error()}
+}
@@ -0,0 +1,424 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/metrics"
+)
+
+const (
+	// Maximum number of concurrent requests done to the upstream registry when indexing.
+	upstreamConcurrency = 10
+
+	// Timeout for requests done to the upstream registry to get package metadata.
+	upstreamMetadataTimeout = 30 * time.Second
+
+	// Prefix of the paths of package artifacts.
+	artifactsPathPrefix = "/epr/"
+)
+
+// Headers forwarded in requests proxied to the upstream registry.
+var upstreamRequestHeaders = []string{
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"Range",
+}
+
+// Headers copied from responses of the upstream registry.
+var upstreamResponseHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+}
+
+// UpstreamIndexer indexes the packages available in another package registry. The content of
+// these packages is served by proxying the requests to the upstream registry.
+type UpstreamIndexer struct {
+	baseURL   string
+	cachePath string
+	client    *http.Client
+
+	mu          sync.RWMutex
+	packageList Packages
+	searchIndex *SearchIndex
+	version     uint64
+}
+
+// NewUpstreamIndexer creates a new UpstreamIndexer for the registry in the given URL. If cachePath
+// is not empty, package artifacts are stored there once downloaded, and served from there.
+func NewUpstreamIndexer(baseURL, cachePath string) *UpstreamIndexer {
+	return &UpstreamIndexer{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		cachePath: cachePath,
+		client:    &http.Client{},
+	}
+}
+
+// Init initializes the indexer.
+func (i *UpstreamIndexer) Init(ctx context.Context) error {
+	packageList, err := i.getPackagesFromUpstream(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "reading packages from upstream registry failed (url: %s)", i.baseURL)
+	}
+
+	searchIndex := NewSearchIndex(packageList)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.packageList = packageList
+	i.searchIndex = searchIndex
+	i.version++
+	return nil
+}
+
+// Get returns a slice with packages.
+// Options can be used to filter the returned list of packages. When no options are passed
+// or they don't contain any filter, no filtering is done.
+// The list is stored in memory, it is only refreshed when the indexer is initialized again.
+func (i *UpstreamIndexer) Get(ctx context.Context, opts *GetOptions) (Packages, error) {
+	i.mu.RLock()
+	packageList, searchIndex := i.packageList, i.searchIndex
+	i.mu.RUnlock()
+
+	if opts == nil {
+		return packageList, nil
+	}
+
+	if opts.Filter != nil {
+		return opts.Filter.WithSearchIndexes(searchIndex).Apply(ctx, packageList), nil
+	}
+
+	return packageList, nil
+}
+
+// SearchIndex returns the search index of the packages currently loaded.
+func (i *UpstreamIndexer) SearchIndex() *SearchIndex {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.searchIndex
+}
+
+// Label returns the kind of indexer, used to identify it in logs and metrics.
+func (i *UpstreamIndexer) Label() string {
+	return "UpstreamIndexer"
+}
+
+// PackagesVersion returns a number that changes every time the list of packages is replaced.
+func (i *UpstreamIndexer) PackagesVersion() uint64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.version
+}
+
+func (i *UpstreamIndexer) getPackagesFromUpstream(ctx context.Context) (Packages, error) {
+	span, ctx := apm.StartSpan(ctx, "GetFromUpstream", "app")
+	span.Context.SetLabel("indexer", "UpstreamIndexer")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.IndexerLoadDuration.WithLabelValues("UpstreamIndexer")).ObserveDuration()
+
+	var basePackages []BasePackage
+	err := i.getJSON(ctx, "/search?all=true&internal=true&experimental=true", &basePackages)
+	if err != nil {
+		return nil, err
+	}
+
+	// Search results only contain a summary of each package, the complete
+	// information is needed to filter packages and to serve their index.
+	pList := make(Packages, len(basePackages))
+	errs := make([]error, len(basePackages))
+	sem := make(chan struct{}, upstreamConcurrency)
+	var wg sync.WaitGroup
+	for n, bp := range basePackages {
+		wg.Add(1)
+		go func(n int, bp BasePackage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pList[n], errs[n] = i.getPackage(ctx, bp.Name, bp.Version)
+		}(n, bp)
+	}
+	wg.Wait()
+
+	// Packages that cannot be loaded are skipped, so a single package doesn't prevent
+	// serving the rest of packages of the upstream registry.
+	log.Printf("Packages in %s:", i.baseURL)
+	var loaded Packages
+	for n, p := range pList {
+		if errs[n] != nil {
+			log.Printf("warning: loading package failed (name: %s, version: %s), ignoring: %v", basePackages[n].Name, basePackages[n].Version, errs[n])
+			continue
+		}
+		loaded = append(loaded, p)
+		log.Printf("%-20s\t%10s\t%s", p.Name, p.Version, p.BasePath)
+	}
+	return loaded, nil
+}
+
+// getPackage gets the complete information of a package from the upstream registry.
+func (i *UpstreamIndexer) getPackage(ctx context.Context, name, version string) (*Package, error) {
+	p := &Package{server: i}
+	urlPath := path.Join(packagePathPrefix, name, version) + "/"
+	err := i.getJSON(ctx, urlPath, p)
+	if err != nil {
+		return nil, err
+	}
+	p.BasePath = i.baseURL + urlPath
+
+	p.versionSemVer, err = semver.StrictNewVersion(p.Version)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid package version")
+	}
+
+	if p.Conditions != nil && p.Conditions.Kibana != nil {
+		p.Conditions.Kibana.constraint, err = semver.NewConstraint(p.Conditions.Kibana.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid Kibana versions range: %s", p.Conditions.Kibana.Version)
+		}
+	}
+
+	// Policy templates in the package index are complete, the summary used in
+	// the /search endpoint needs to be built from them.
+	for _, t := range p.PolicyTemplates {
+		p.BasePolicyTemplates = append(p.BasePolicyTemplates, BasePolicyTemplate{
+			Name:        t.Name,
+			Title:       t.Title,
+			Description: t.Description,
+			Icons:       t.Icons,
+			Categories:  t.Categories,
+		})
+	}
+
+	for _, d := range p.DataStreams {
+		d.packageRef = p
+	}
+
+	return p, nil
+}
+
+func (i *UpstreamIndexer) getJSON(ctx context.Context, urlPath string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamMetadataTimeout)
+	defer cancel()
+
+	upstreamURL, err := i.upstreamURL(urlPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request to upstream registry failed (path: %s)", urlPath)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from upstream registry (path: %s)", resp.StatusCode, urlPath)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrapf(err, "decoding response from upstream registry failed (path: %s)", urlPath)
+	}
+	return nil
+}
+
+func (i *UpstreamIndexer) servePackage(w http.ResponseWriter, r *http.Request, p *Package) {
+	i.serveArtifact(w, r, p.GetDownloadPath())
+}
+
+func (i *UpstreamIndexer) servePackageTarGz(w http.ResponseWriter, r *http.Request, p *Package) {
+	i.serveArtifact(w, r, p.GetTarGzDownloadPath())
+}
+
+func (i *UpstreamIndexer) serveSignature(w http.ResponseWriter, r *http.Request, p *Package) {
+	if p.SignaturePath == "" {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+	i.serveArtifact(w, r, p.SignaturePath)
+}
+
+func (i *UpstreamIndexer) serveFile(w http.ResponseWriter, r *http.Request, p *Package, name string) {
+	i.proxy(w, r, path.Join(p.GetUrlPath(), name))
+}
+
+// serveArtifact serves an artifact from the cache, downloading it if it is not there yet.
+// If there is no cache, the request is proxied to the upstream registry. Paths of artifacts
+// can be obtained from the upstream registry, so only paths of artifacts are accepted.
+func (i *UpstreamIndexer) serveArtifact(w http.ResponseWriter, r *http.Request, urlPath string) {
+	urlPath = path.Clean("/" + urlPath)
+	if !strings.HasPrefix(urlPath, artifactsPathPrefix) {
+		log.Printf("invalid artifact path from upstream registry (path: %s)", urlPath)
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+
+	if i.cachePath == "" {
+		i.proxy(w, r, urlPath)
+		return
+	}
+
+	cachedPath := filepath.Join(i.cachePath, filepath.FromSlash(strings.TrimPrefix(urlPath, "/")))
+	if !isSubPath(i.cachePath, cachedPath) {
+		log.Printf("invalid artifact path from upstream registry (path: %s)", urlPath)
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+	_, err := os.Stat(cachedPath)
+	if os.IsNotExist(err) {
+		err = i.download(r.Context(), urlPath, cachedPath)
+	}
+	if err != nil {
+		log.Printf("getting artifact from upstream registry failed (path: %s): %v", urlPath, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	http.ServeFile(w, r, cachedPath)
+}
+
+// download downloads a resource of the upstream registry to the given path. The file
+// is written first to a temporary file, so incomplete downloads are never served.
+func (i *UpstreamIndexer) download(ctx context.Context, urlPath, dest string) error {
+	upstreamURL, err := i.upstreamURL(urlPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request to upstream registry failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return errors.Wrap(err, "creating cache directory failed")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file failed")
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "downloading file failed")
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing temporary file failed")
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+// proxy serves a resource of the upstream registry.
+func (i *UpstreamIndexer) proxy(w http.ResponseWriter, r *http.Request, urlPath string) {
+	upstreamURL, err := i.upstreamURL(urlPath)
+	if err != nil {
+		log.Printf("invalid path for upstream registry (path: %s): %v", urlPath, err)
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, nil)
+	if err != nil {
+		log.Printf("building request to upstream registry failed (path: %s): %v", urlPath, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, header := range upstreamRequestHeaders {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		log.Printf("request to upstream registry failed (path: %s): %v", urlPath, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range upstreamResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		log.Printf("copying response from upstream registry failed (path: %s): %v", urlPath, err)
+	}
+}
+
+// upstreamURL returns the URL of a resource of the upstream registry. Paths can be obtained
+// from the upstream registry, so they are cleaned and resolved relative to the base URL, and
+// they cannot refer to resources in other hosts.
+func (i *UpstreamIndexer) upstreamURL(urlPath string) (string, error) {
+	ref, err := url.Parse(urlPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid path (path: %s)", urlPath)
+	}
+	if ref.Scheme != "" || ref.Host != "" || ref.User != nil || !strings.HasPrefix(ref.Path, "/") {
+		return "", errors.Errorf("path must be absolute and in the upstream registry (path: %s)", urlPath)
+	}
+
+	base, err := url.Parse(i.baseURL + "/")
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid upstream registry URL (url: %s)", i.baseURL)
+	}
+	// Trailing slashes are kept, they are part of the paths of package indexes.
+	cleanPath := strings.TrimPrefix(path.Clean(ref.Path), "/")
+	if strings.HasSuffix(ref.Path, "/") && cleanPath != "" {
+		cleanPath += "/"
+	}
+	relative := &url.URL{
+		Path:     cleanPath,
+		RawQuery: ref.RawQuery,
+	}
+	return base.ResolveReference(relative).String(), nil
+}
+
+// isSubPath checks if path is inside the given directory, once both are cleaned.
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,97 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamURL(t *testing.T) {
+	indexer := NewUpstreamIndexer("https://epr.example.com/registry/", "")
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/search?all=true", "https://epr.example.com/registry/search?all=true"},
+		{"/epr/example/example-1.0.0.zip", "https://epr.example.com/registry/epr/example/example-1.0.0.zip"},
+		{"/package/example/1.0.0/", "https://epr.example.com/registry/package/example/1.0.0/"},
+		{"/epr/../../../etc/passwd", "https://epr.example.com/registry/etc/passwd"},
+		{"/@attacker.example.com/x", "https://epr.example.com/registry/@attacker.example.com/x"},
+		{"//attacker.example.com/x", ""},
+		{"https://attacker.example.com/x", ""},
+		{"@attacker.example.com/x", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			result, err := indexer.upstreamURL(c.path)
+			if c.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.expected, result)
+			}
+		})
+	}
+}
+
+func TestUpstreamInvalidSignaturePath(t *testing.T) {
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Write([]byte("signature"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache")
+	indexer := NewUpstreamIndexer(upstream.URL, cachePath)
+
+	for _, signaturePath := range []string{"/../../escaped.sig", "/package/example/1.0.0/escaped.sig", "@127.0.0.1/epr/x.sig"} {
+		t.Run(signaturePath, func(t *testing.T) {
+			p := &Package{BasePackage: BasePackage{SignaturePath: signaturePath}}
+			recorder := httptest.NewRecorder()
+			indexer.serveSignature(recorder, httptest.NewRequest(http.MethodGet, "/epr/example/example-1.0.0.zip.sig", nil), p)
+			assert.Equal(t, http.StatusNotFound, recorder.Code)
+		})
+	}
+	assert.Zero(t, atomic.LoadInt64(&requests))
+	_, err := os.Stat(filepath.Join(dir, "escaped.sig"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUpstreamSkipsFailedPackages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search":
+			w.Write([]byte(`[{"name": "good", "version": "1.0.0"}, {"name": "broken", "version": "1.0.0"}]`))
+		case "/package/good/1.0.0/":
+			w.Write([]byte(`{"name": "good", "version": "1.0.0", "title": "Good"}`))
+		default:
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	indexer := NewUpstreamIndexer(upstream.URL, "")
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	assert.Equal(t, "good", packages[0].Name)
+}
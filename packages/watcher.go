@@ -0,0 +1,309 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// reloadDelay is the time waited since a change is detected until packages are reloaded.
+// It avoids reloading packages while they are still being copied.
+const reloadDelay = 1 * time.Second
+
+// Watch watches the paths of the indexer and reloads the packages affected by changes in them,
+// until the context is done.
+func (i *FileSystemIndexer) Watch(ctx context.Context, pollInterval time.Duration) {
+	WatchFileSystemIndexers(ctx, pollInterval, i)
+}
+
+// WatchFileSystemIndexers watches the paths of the given indexers and reloads the packages
+// affected by changes in them, until the context is done. A single watcher is used for all
+// the indexers, so indexers of different kinds of packages in the same paths share it.
+// File system notifications are used when available, if they cannot be used, the paths are
+// polled every pollInterval.
+// Packages that cannot be loaded during a reload are logged and skipped.
+func WatchFileSystemIndexers(ctx context.Context, pollInterval time.Duration, indexers ...*FileSystemIndexer) {
+	w := newFileSystemWatcher(indexers...)
+	err := w.watchNotifications(ctx)
+	if err == nil {
+		return
+	}
+
+	log.Printf("warning: cannot watch paths of %s, polling them every %s: %v", w.label(), pollInterval, err)
+	w.watchPolling(ctx, pollInterval)
+}
+
+// fileSystemWatcher watches the paths of a set of indexers, and reloads the indexers affected
+// by the changes.
+type fileSystemWatcher struct {
+	indexers []*FileSystemIndexer
+	paths    []string
+}
+
+func newFileSystemWatcher(indexers ...*FileSystemIndexer) *fileSystemWatcher {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, indexer := range indexers {
+		for _, path := range indexer.paths {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return &fileSystemWatcher{
+		indexers: indexers,
+		paths:    paths,
+	}
+}
+
+func (w *fileSystemWatcher) label() string {
+	labels := make([]string, len(w.indexers))
+	for i, indexer := range w.indexers {
+		labels[i] = indexer.label
+	}
+	return strings.Join(labels, ", ")
+}
+
+func (w *fileSystemWatcher) watchNotifications(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "creating file system watcher failed")
+	}
+	defer watcher.Close()
+
+	for _, basePath := range w.paths {
+		if _, err := os.Stat(basePath); os.IsNotExist(err) {
+			log.Printf("warning: packages path %s doesn't exist, changes on it won't be detected", basePath)
+			continue
+		}
+		err := watchTree(watcher, basePath)
+		if err != nil {
+			return errors.Wrapf(err, "watching path failed (path: %s)", basePath)
+		}
+	}
+
+	var changed []string
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				// New directories need to be watched too.
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					err := watchTree(watcher, event.Name)
+					if err != nil {
+						log.Printf("warning: watching path failed (path: %s): %v", event.Name, err)
+					}
+				}
+			}
+			resetTimer(timer, reloadDelay)
+			changed = append(changed, event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Some events may have been lost, reload everything.
+			log.Printf("warning: watching paths of %s failed, all packages will be reloaded: %v", w.label(), err)
+			resetTimer(timer, reloadDelay)
+			changed = append(changed, w.paths...)
+		case <-timer.C:
+			w.reload(ctx, changed)
+			changed = nil
+		}
+	}
+}
+
+// resetTimer stops the timer and resets it to fire after the given delay, so changes are only
+// handled once no more events are received during this delay.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		// Drain the channel if the timer fired but its value was not received yet.
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// watchTree adds to the watcher all the directories under the given path.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, info os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (w *fileSystemWatcher) watchPolling(ctx context.Context, pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	previous := snapshot(w.paths)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := snapshot(w.paths)
+			changed := previous.changes(current)
+			previous = current
+			if len(changed) > 0 {
+				w.reload(ctx, changed)
+			}
+		}
+	}
+}
+
+// reload reloads the indexers with paths affected by the changed paths.
+func (w *fileSystemWatcher) reload(ctx context.Context, changed []string) {
+	for _, indexer := range w.indexers {
+		affected := indexer.affectedPaths(changed)
+		if len(affected) > 0 {
+			indexer.reload(ctx, affected)
+		}
+	}
+}
+
+// affectedPaths returns the changed paths that are in the paths of the indexer, or contain them.
+func (i *FileSystemIndexer) affectedPaths(changed []string) []string {
+	var affected []string
+	for _, path := range changed {
+		path = filepath.Clean(path)
+		for _, basePath := range i.paths {
+			basePath = filepath.Clean(basePath)
+			if isSubpath(path, basePath) || isSubpath(basePath, path) {
+				affected = append(affected, path)
+				break
+			}
+		}
+	}
+	return affected
+}
+
+// reload reloads the packages affected by the changed paths, the rest of packages are reused.
+// The list of packages is replaced once the new list is completely built.
+func (i *FileSystemIndexer) reload(ctx context.Context, changed []string) {
+	i.reloadMutex.Lock()
+	defer i.reloadMutex.Unlock()
+
+	reuse := make(map[string]*Package)
+	for _, p := range i.packages() {
+		if !isAffectedPath(p.BasePath, changed) {
+			reuse[p.BasePath] = p
+		}
+	}
+
+	packageList, failed, err := i.getPackagesFromFileSystem(ctx, loadOptions{
+		reuse:       reuse,
+		skipInvalid: true,
+	})
+	if err != nil {
+		log.Printf("warning: reloading packages of %s failed, keeping previous packages: %v", i.label, err)
+		return
+	}
+	i.setPackages(packageList)
+
+	log.Printf("%s reloaded: %d packages available, %d failed to load", i.label, len(packageList), failed)
+}
+
+// packageFileSuffixes are the suffixes of the files stored along packages, that are also
+// considered part of them.
+var packageFileSuffixes = []string{".sig", ".sha256", lifecycleSuffix}
+
+// isAffectedPath checks if any of the changed paths can affect the package in the given path.
+// These are the paths in the package, the paths containing it, and the files stored along it,
+// as signatures.
+func isAffectedPath(packagePath string, changed []string) bool {
+	packagePath = filepath.Clean(packagePath)
+	for _, path := range changed {
+		path = filepath.Clean(path)
+		if isSubpath(path, packagePath) || isSubpath(packagePath, path) {
+			return true
+		}
+		for _, suffix := range packageFileSuffixes {
+			if path == packagePath+suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSubpath checks if path is the same as parent, or if it is under it.
+func isSubpath(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, parent+string(filepath.Separator))
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// filesSnapshot contains the state of the files found under some paths, indexed by path.
+type filesSnapshot map[string]fileState
+
+func snapshot(paths []string) filesSnapshot {
+	snapshot := make(filesSnapshot)
+	for _, basePath := range paths {
+		filepath.WalkDir(basePath, func(path string, info os.DirEntry, err error) error {
+			// Ignore errors, files can disappear while walking. They will be considered removed.
+			if err != nil {
+				return nil
+			}
+			// Only files are considered, changes in directories are reflected in their files.
+			if info.IsDir() {
+				return nil
+			}
+			fileInfo, err := info.Info()
+			if err != nil {
+				return nil
+			}
+			snapshot[path] = fileState{
+				size:    fileInfo.Size(),
+				modTime: fileInfo.ModTime(),
+			}
+			return nil
+		})
+	}
+	return snapshot
+}
+
+// changes returns the paths of the files created, removed or modified between both snapshots.
+func (s filesSnapshot) changes(current filesSnapshot) []string {
+	var changed []string
+	for path, state := range s {
+		currentState, found := current[path]
+		if !found || currentState.size != state.size || !currentState.modTime.Equal(state.modTime) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range current {
+		if _, found := s[path]; !found {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
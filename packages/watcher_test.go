@@ -0,0 +1,148 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package packages
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/util"
+)
+
+func TestWatch(t *testing.T) {
+	cases := []struct {
+		title string
+		watch func(ctx context.Context, indexer *FileSystemIndexer)
+	}{
+		{
+			title: "notifications",
+			watch: func(ctx context.Context, indexer *FileSystemIndexer) {
+				indexer.Watch(ctx, time.Hour)
+			},
+		},
+		{
+			title: "polling",
+			watch: func(ctx context.Context, indexer *FileSystemIndexer) {
+				newFileSystemWatcher(indexer).watchPolling(ctx, 100*time.Millisecond)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			basePath := t.TempDir()
+			require.NoError(t, util.CopyDir("../testdata/package/example/1.0.0", filepath.Join(basePath, "example", "1.0.0")))
+
+			indexer := NewFileSystemIndexer(basePath)
+			err := indexer.Init(context.Background())
+			require.NoError(t, err)
+			assertPackages(t, indexer, "example-1.0.0")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go c.watch(ctx, indexer)
+
+			// Give some time to the watcher to start.
+			time.Sleep(200 * time.Millisecond)
+
+			require.NoError(t, util.CopyDir("../testdata/package/reference/1.0.0", filepath.Join(basePath, "reference", "1.0.0")))
+			waitForPackages(t, indexer, "example-1.0.0", "reference-1.0.0")
+
+			// Invalid packages are skipped.
+			invalidPath := filepath.Join(basePath, "invalid", "1.0.0")
+			err = os.MkdirAll(invalidPath, 0755)
+			require.NoError(t, err)
+			err = ioutil.WriteFile(filepath.Join(invalidPath, "manifest.yml"), []byte("name: invalid\n"), 0644)
+			require.NoError(t, err)
+			require.NoError(t, util.CopyDir("../testdata/package/multiversion/1.0.4", filepath.Join(basePath, "multiversion", "1.0.4")))
+			waitForPackages(t, indexer, "example-1.0.0", "multiversion-1.0.4", "reference-1.0.0")
+
+			err = os.RemoveAll(filepath.Join(basePath, "reference"))
+			require.NoError(t, err)
+			waitForPackages(t, indexer, "example-1.0.0", "multiversion-1.0.4")
+		})
+	}
+}
+
+func TestWatchFileSystemIndexers(t *testing.T) {
+	basePath := t.TempDir()
+	require.NoError(t, util.CopyDir("../testdata/package/example/1.0.0", filepath.Join(basePath, "example", "1.0.0")))
+
+	indexer := NewFileSystemIndexer(basePath)
+	zipIndexer := NewZipFileSystemIndexer(basePath)
+	for _, i := range []*FileSystemIndexer{indexer, zipIndexer} {
+		err := i.Init(context.Background())
+		require.NoError(t, err)
+	}
+	assertPackages(t, indexer, "example-1.0.0")
+	assertPackages(t, zipIndexer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchFileSystemIndexers(ctx, time.Hour, indexer, zipIndexer)
+
+	// Give some time to the watcher to start.
+	time.Sleep(200 * time.Millisecond)
+
+	// Both indexers are reloaded from the same watcher.
+	require.NoError(t, util.CopyDir("../testdata/package/reference/1.0.0", filepath.Join(basePath, "reference", "1.0.0")))
+	require.NoError(t, util.CopyDir("../testdata/local-storage", basePath))
+	waitForPackages(t, indexer, "example-1.0.0", "reference-1.0.0")
+	waitForPackages(t, zipIndexer, "example-1.0.1")
+}
+
+func TestIsAffectedPath(t *testing.T) {
+	cases := []struct {
+		changed  string
+		affected bool
+	}{
+		{"/pkgs/foo/1.0.0", true},
+		{"/pkgs/foo/1.0.0/manifest.yml", true},
+		{"/pkgs/foo", true},
+		{"/pkgs", true},
+		{"/pkgs/foo/1.0.0.sig", true},
+		{"/pkgs/foo/1.0.0.lifecycle.yml", true},
+		{"/pkgs/foo/1.0.0-rc", false},
+		{"/pkgs/foo/1.0.0-rc/manifest.yml", false},
+		{"/pkgs/foo/1.0", false},
+		{"/pkgs/foobar", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.changed, func(t *testing.T) {
+			assert.Equal(t, c.affected, isAffectedPath("/pkgs/foo/1.0.0", []string{c.changed}))
+		})
+	}
+}
+
+func waitForPackages(t *testing.T, indexer *FileSystemIndexer, expected ...string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, packageIDs(t, indexer))
+	}, 10*time.Second, 50*time.Millisecond, "expected packages: %v, found: %v", expected, packageIDs(t, indexer))
+}
+
+func assertPackages(t *testing.T, indexer *FileSystemIndexer, expected ...string) {
+	t.Helper()
+	assert.Equal(t, expected, packageIDs(t, indexer))
+}
+
+func packageIDs(t *testing.T, indexer *FileSystemIndexer) []string {
+	packages, err := indexer.Get(context.Background(), nil)
+	require.NoError(t, err)
+
+	var ids []string
+	for _, p := range packages {
+		ids = append(ids, p.Name+"-"+p.Version)
+	}
+	return ids
+}
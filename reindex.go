@@ -0,0 +1,213 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/metrics"
+	"github.com/elastic/package-registry/util"
+)
+
+const reindexRouterPath = "/admin/reindex"
+
+// generation is a set of indexer and handler built from the same configuration.
+type generation struct {
+	config  *Config
+	indexer CombinedIndexer
+	handler http.Handler
+
+	// stopWatch stops watching for changes in the packages of this generation.
+	stopWatch context.CancelFunc
+}
+
+// reindexer serves requests with the current generation, and replaces it with a new one when
+// a reindex is requested. Requests in flight are completed with the generation they started with.
+type reindexer struct {
+	tracer *apm.Tracer
+
+	// reindexMutex serializes reindexes.
+	reindexMutex sync.Mutex
+
+	mu      sync.RWMutex
+	current *generation
+}
+
+type reindexResult struct {
+	Packages int `json:"packages"`
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Failed   int `json:"failed"`
+	Shadowed int `json:"shadowed"`
+}
+
+func newReindexer(tracer *apm.Tracer) *reindexer {
+	return &reindexer{tracer: tracer}
+}
+
+// init sets the first generation, with an already initialized indexer.
+func (r *reindexer) init(config *Config, indexer CombinedIndexer) error {
+	g, err := r.newGeneration(config, indexer)
+	if err != nil {
+		return err
+	}
+	r.setGeneration(g)
+	metrics.IndexerPackages.SetSource(r.countPackages)
+	return nil
+}
+
+func (r *reindexer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	handler := r.current.handler
+	r.mu.RUnlock()
+
+	handler.ServeHTTP(w, req)
+}
+
+// reindex reads again the configuration and all the packages, and replaces the current
+// generation. If anything fails, the current generation is kept.
+func (r *reindexer) reindex(ctx context.Context) (*reindexResult, error) {
+	r.reindexMutex.Lock()
+	defer r.reindexMutex.Unlock()
+
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	printConfig(config)
+
+	indexer, err := newIndexer(config)
+	if err != nil {
+		return nil, err
+	}
+	failed, err := indexer.Reload(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading packages failed")
+	}
+
+	result, err := comparePackages(ctx, r.generation().indexer, indexer)
+	if err != nil {
+		return nil, err
+	}
+	if result.Packages == 0 {
+		return nil, errors.New("no packages available")
+	}
+	result.Failed = failed
+
+	shadowed, err := indexer.Shadowed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result.Shadowed = len(shadowed)
+
+	g, err := r.newGeneration(config, indexer)
+	if err != nil {
+		return nil, err
+	}
+	err = configureLogging(loggingConfig(config))
+	if err != nil {
+		g.stopWatch()
+		return nil, err
+	}
+	previous := r.setGeneration(g)
+	previous.stopWatch()
+
+	return result, nil
+}
+
+func (r *reindexer) newGeneration(config *Config, indexer CombinedIndexer) (*generation, error) {
+	router, err := getRouter(config, indexer, r)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.WatchEnabled {
+		go indexer.Watch(ctx, config.WatchPollInterval)
+	}
+
+	return &generation{
+		config:    config,
+		indexer:   indexer,
+		handler:   router,
+		stopWatch: cancel,
+	}, nil
+}
+
+func (r *reindexer) generation() *generation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// countPackages returns the number of packages served by the current generation, by kind
+// of indexer.
+func (r *reindexer) countPackages() map[string]int {
+	return r.generation().indexer.countPackages(context.Background())
+}
+
+// setGeneration replaces the current generation, and returns the previous one.
+func (r *reindexer) setGeneration(g *generation) *generation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.current
+	r.current = g
+	return previous
+}
+
+// comparePackages counts the packages added and removed between two indexers.
+func comparePackages(ctx context.Context, previous, current Indexer) (*reindexResult, error) {
+	previousPackages, err := previous.Get(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting previous packages failed")
+	}
+	currentPackages, err := current.Get(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting current packages failed")
+	}
+
+	found := make(map[string]struct{})
+	for _, p := range previousPackages {
+		found[p.Name+"-"+p.Version] = struct{}{}
+	}
+
+	result := reindexResult{Packages: len(currentPackages)}
+	for _, p := range currentPackages {
+		key := p.Name + "-" + p.Version
+		if _, ok := found[key]; ok {
+			delete(found, key)
+			continue
+		}
+		result.Added++
+	}
+	result.Removed = len(found)
+	return &result, nil
+}
+
+// reindexHandler triggers a reindex and reports the changes found.
+func reindexHandler(r *reindexer) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		result, err := r.reindex(req.Context())
+		if err != nil {
+			log.Printf("reindex failed: %v", err)
+			noCacheHeaders(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		noCacheHeaders(w)
+		jsonHeader(w)
+		err = util.WriteJSONPretty(w, result)
+		if err != nil {
+			log.Printf("marshaling reindex result failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm"
+
+	"github.com/elastic/package-registry/metrics"
+	"github.com/elastic/package-registry/util"
+)
+
+func TestReindex(t *testing.T) {
+	const token = "secret"
+
+	tmpDir := t.TempDir()
+	packagesPath := filepath.Join(tmpDir, "packages")
+	require.NoError(t, util.CopyDir("testdata/package/example/1.0.0", filepath.Join(packagesPath, "example", "1.0.0")))
+	require.NoError(t, util.CopyDir("testdata/package/reference/1.0.0", filepath.Join(packagesPath, "reference", "1.0.0")))
+
+	testConfigPath := filepath.Join(tmpDir, "config.yml")
+	writeTestConfig(t, testConfigPath, packagesPath, token)
+	defer func(path string) { configPath = path }(configPath)
+	configPath = testConfigPath
+
+	config, err := getConfig()
+	require.NoError(t, err)
+	indexer, err := newIndexer(config)
+	require.NoError(t, err)
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	reindexer := newReindexer(apm.DefaultTracer)
+	err = reindexer.init(config, indexer)
+	require.NoError(t, err)
+
+	assertPackageStatus(t, reindexer, "/package/reference/1.0.0/", http.StatusOK)
+	assertPackageStatus(t, reindexer, "/package/multiversion/1.0.4/", http.StatusNotFound)
+	assertIndexerPackages(t, 2)
+
+	// Add a package, remove other one, and add an invalid one.
+	require.NoError(t, util.CopyDir("testdata/package/multiversion/1.0.4", filepath.Join(packagesPath, "multiversion", "1.0.4")))
+	err = os.RemoveAll(filepath.Join(packagesPath, "reference"))
+	require.NoError(t, err)
+	invalidPath := filepath.Join(packagesPath, "invalid", "1.0.0")
+	err = os.MkdirAll(invalidPath, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(invalidPath, "manifest.yml"), []byte("name: invalid\n"), 0644)
+	require.NoError(t, err)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, reindexRouterPath, nil)
+		req.Header.Set("Authorization", "Bearer other")
+		recorder := httptest.NewRecorder()
+		reindexer.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, reindexRouterPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		reindexer.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		var result reindexResult
+		err := json.Unmarshal(recorder.Body.Bytes(), &result)
+		require.NoError(t, err)
+		assert.Equal(t, reindexResult{Packages: 2, Added: 1, Removed: 1, Failed: 1}, result)
+
+		assertPackageStatus(t, reindexer, "/package/reference/1.0.0/", http.StatusNotFound)
+		assertPackageStatus(t, reindexer, "/package/multiversion/1.0.4/", http.StatusOK)
+		assertIndexerPackages(t, 2)
+	})
+
+	t.Run("failed reindex keeps previous generation", func(t *testing.T) {
+		writeTestConfig(t, testConfigPath, filepath.Join(tmpDir, "empty"), token)
+		_, err := reindexer.reindex(context.Background())
+		assert.Error(t, err)
+
+		assertPackageStatus(t, reindexer, "/package/multiversion/1.0.4/", http.StatusOK)
+	})
+}
+
+func writeTestConfig(t *testing.T, path, packagesPath, token string) {
+	config := fmt.Sprintf("package_paths:\n  - %s\nadmin.token: %s\n", packagesPath, token)
+	err := ioutil.WriteFile(path, []byte(config), 0644)
+	require.NoError(t, err)
+}
+
+// assertIndexerPackages checks the number of packages reported in metrics for the file system
+// indexers of the current generation.
+func assertIndexerPackages(t *testing.T, count int) {
+	t.Helper()
+	expected := fmt.Sprintf(`
+# HELP epr_indexer_packages Number of packages loaded by indexers.
+# TYPE epr_indexer_packages gauge
+epr_indexer_packages{indexer="FileSystemIndexer"} %d
+epr_indexer_packages{indexer="TarGzFileSystemIndexer"} 0
+epr_indexer_packages{indexer="ZipFileSystemIndexer"} 0
+`, count)
+	err := testutil.CollectAndCompare(metrics.IndexerPackages, strings.NewReader(expected))
+	assert.NoError(t, err)
+}
+
+func assertPackageStatus(t *testing.T, handler http.Handler, endpoint string, status int) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, endpoint, nil))
+	assert.Equal(t, status, recorder.Code)
+}
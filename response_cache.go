@@ -0,0 +1,206 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/package-registry/metrics"
+	"github.com/elastic/package-registry/util"
+)
+
+const cacheStatsRouterPath = "/admin/cache"
+
+// Approximated memory used by each cache entry, in addition to its key and bodies.
+const cacheEntryOverhead = 256
+
+// responseCache keeps the responses of the most recent requests, so they don't need to be
+// built again while the packages don't change. Entries are keyed by the normalized request,
+// so equivalent requests share the same entry.
+//
+// The cache is emptied when the list of packages of the indexer changes. When the memory
+// budget is exceeded, least recently used entries are evicted.
+type responseCache struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	version uint64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   responseCacheStats
+}
+
+// cachedResponse is a response stored in the response cache.
+type cachedResponse struct {
+	key  string
+	json *jsonResponse
+
+	// total is the number of results before paginating them, for paginated responses.
+	total int
+}
+
+func (r *cachedResponse) size() int64 {
+	size := len(r.key) + len(r.json.body) + cacheEntryOverhead
+	for _, compressed := range r.json.precompressed {
+		size += len(compressed)
+	}
+	return int64(size)
+}
+
+// responseCacheStats are the statistics of the usage of the cache.
+type responseCacheStats struct {
+	Entries       int   `json:"entries"`
+	Size          int64 `json:"size"`
+	MaxSize       int64 `json:"max_size"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// newResponseCache creates a cache that uses up to maxSize bytes. If maxSize is zero or
+// negative, it returns nil, what is a valid cache that doesn't store anything.
+func newResponseCache(maxSize int64) *responseCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &responseCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get looks for a response in the cache. The version is the version of the list of packages
+// used to build the response, if it differs from the one of the entries in the cache, all
+// entries are discarded.
+func (c *responseCache) get(version uint64, key string) (*cachedResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateOnVersionChange(version)
+
+	element, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		metrics.CacheRequests.WithLabelValues("response", metrics.CacheMiss).Inc()
+		return nil, false
+	}
+	c.stats.Hits++
+	metrics.CacheRequests.WithLabelValues("response", metrics.CacheHit).Inc()
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedResponse), true
+}
+
+// add stores a response built with the given version of the list of packages.
+func (c *responseCache) add(version uint64, response *cachedResponse) {
+	if c == nil {
+		return
+	}
+
+	size := response.size()
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateOnVersionChange(version)
+	if version != c.version {
+		// Response built with an old list of packages.
+		return
+	}
+
+	if element, found := c.entries[response.key]; found {
+		c.remove(element)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[response.key] = c.lru.PushFront(response)
+	c.size += size
+}
+
+func (c *responseCache) invalidateOnVersionChange(version uint64) {
+	if version <= c.version {
+		return
+	}
+	if len(c.entries) > 0 {
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		c.size = 0
+		c.stats.Invalidations++
+	}
+	c.version = version
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	response := c.lru.Remove(element).(*cachedResponse)
+	delete(c.entries, response.key)
+	c.size -= response.size()
+}
+
+// Stats returns the current statistics of the cache.
+func (c *responseCache) Stats() responseCacheStats {
+	if c == nil {
+		return responseCacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Size = c.size
+	stats.MaxSize = c.maxSize
+	return stats
+}
+
+// getOrBuild returns a response from the cache, or builds it and stores it in the cache if it
+// is not there. The build function returns false if the response cannot be built, after writing
+// the error. Responses are only cached if the indexer can tell when its packages change.
+func (c *responseCache) getOrBuild(indexer Indexer, key string, build func() (*cachedResponse, bool)) (*cachedResponse, bool) {
+	version, versioned := packagesVersion(indexer)
+	if versioned {
+		if response, found := c.get(version, key); found {
+			return response, true
+		}
+	}
+
+	response, ok := build()
+	if !ok {
+		return nil, false
+	}
+	response.key = key
+	if versioned && c != nil {
+		precompressed, err := newPrecompressedJSONResponse(response.json.body)
+		if err != nil {
+			log.Printf("precompressing response failed: %v", err)
+		} else {
+			response.json = precompressed
+		}
+		c.add(version, response)
+	}
+	return response, true
+}
+
+// cacheStatsHandler reports the statistics of the response cache.
+func cacheStatsHandler(cache *responseCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		noCacheHeaders(w)
+		jsonHeader(w)
+		err := util.WriteJSONPretty(w, cache.Stats())
+		if err != nil {
+			log.Printf("writing cache stats failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
+)
+
+func TestResponseCache(t *testing.T) {
+	packagesPath := t.TempDir()
+	require.NoError(t, util.CopyDir("./testdata/package/example/1.0.0", filepath.Join(packagesPath, "example", "1.0.0")))
+
+	indexer := packages.NewFileSystemIndexer(packagesPath)
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	cache := newResponseCache(1024 * 1024)
+	handler := searchHandler(NewCombinedIndexer(indexer), cache, testCacheTime)
+	search := func(endpoint string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, endpoint, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder
+	}
+
+	first := search("/search?q=Example")
+	assert.Equal(t, responseCacheStats{Entries: 1, Size: cache.Stats().Size, MaxSize: 1024 * 1024, Misses: 1}, cache.Stats())
+
+	// Equivalent queries are served from the same entry.
+	second := search("/search?q=example&sort=")
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+	stats := cache.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+
+	search("/search?q=example&all=true")
+	stats = cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(2), stats.Misses)
+
+	// Cache is invalidated when packages change.
+	require.NoError(t, util.CopyDir("./testdata/package/example/1.1.0", filepath.Join(packagesPath, "example", "1.1.0")))
+	_, err = indexer.Reload(context.Background())
+	require.NoError(t, err)
+
+	updated := search("/search?q=example")
+	assert.NotEqual(t, first.Body.String(), updated.Body.String())
+	stats = cache.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, int64(1), stats.Invalidations)
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	response := func(key string, size int) *cachedResponse {
+		return &cachedResponse{
+			key:  key,
+			json: newJSONResponse(make([]byte, size-len(key)-cacheEntryOverhead)),
+		}
+	}
+
+	cache := newResponseCache(1000)
+	cache.add(1, response("a", 400))
+	cache.add(1, response("b", 400))
+	_, found := cache.get(1, "a")
+	assert.True(t, found)
+
+	// Least recently used entry is evicted.
+	cache.add(1, response("c", 400))
+	_, found = cache.get(1, "b")
+	assert.False(t, found)
+	_, found = cache.get(1, "a")
+	assert.True(t, found)
+	_, found = cache.get(1, "c")
+	assert.True(t, found)
+
+	// Entries bigger than the cache are not stored.
+	cache.add(1, response("d", 2000))
+	_, found = cache.get(1, "d")
+	assert.False(t, found)
+
+	// Entries built with old versions of the packages are not stored.
+	_, found = cache.get(2, "a")
+	assert.False(t, found)
+	cache.add(1, response("e", 400))
+	_, found = cache.get(2, "e")
+	assert.False(t, found)
+
+	assert.Equal(t, responseCacheStats{
+		Entries:       0,
+		Size:          0,
+		MaxSize:       1000,
+		Hits:          3,
+		Misses:        4,
+		Evictions:     1,
+		Invalidations: 1,
+	}, cache.Stats())
+}
@@ -0,0 +1,251 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestS3Indexer(t *testing.T) {
+	config := Config{
+		CacheTimeIndex:      testCacheTime,
+		CacheTimeSearch:     testCacheTime,
+		CacheTimeCategories: testCacheTime,
+		CacheTimeCatchAll:   testCacheTime,
+	}
+
+	storage := newTestObjectStorage("packages", map[string]string{
+		"production/example-1.0.1.zip":        "testdata/local-storage/example-1.0.1.zip",
+		"production/example-1.0.1.zip.sig":    "testdata/local-storage/example-1.0.1.zip.sig",
+		"production/example-1.0.1.zip.sha256": "testdata/local-storage/example-1.0.1.zip.sha256",
+		"production/not-a-package.zip":        "testdata/package/example/1.0.0/manifest.yml",
+		"staging/example-1.0.1.zip":           "testdata/local-storage/example-1.0.1.zip",
+	})
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	client, err := newS3Client(BucketConfig{
+		Bucket:          "packages",
+		Region:          "us-east-1",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+	})
+	require.NoError(t, err)
+	indexer := packages.NewS3Indexer(client, "packages", "production/")
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	// Packages are indexed without downloading complete packages, checksums are read from
+	// their own objects.
+	assert.Equal(t, []string{"production/example-1.0.1.zip.sha256"}, storage.completeReads())
+
+	expectedIndexer := packages.NewZipFileSystemIndexer("./testdata/local-storage")
+	err = expectedIndexer.Init(context.Background())
+	require.NoError(t, err)
+
+	router, err := getRouter(&config, indexer, nil)
+	require.NoError(t, err)
+	expectedRouter, err := getRouter(&config, expectedIndexer, nil)
+	require.NoError(t, err)
+
+	endpoints := []struct {
+		endpoint string
+		headers  map[string]string
+	}{
+		{endpoint: "/search?all=true"},
+		{endpoint: "/categories?include_policy_templates=true"},
+		{endpoint: "/package/example/1.0.1/"},
+		{endpoint: "/package/example/1.0.1/docs/README.md"},
+		{endpoint: "/package/example/1.0.1/img/kibana-envoyproxy.jpg"},
+		{endpoint: "/package/example/1.0.1/missing.md"},
+		{endpoint: "/epr/example/example-1.0.1.zip"},
+		{endpoint: "/epr/example/example-1.0.1.zip", headers: map[string]string{"Range": "bytes=100-199"}},
+		{endpoint: "/epr/example/example-1.0.1.zip.sig"},
+		{endpoint: "/epr/example/example-1.0.1.zip.sha256"},
+		{endpoint: "/epr/example/example-1.0.1.tar.gz"},
+		{endpoint: "/epr/example/example-1.0.1.tar.gz", headers: map[string]string{"Range": "bytes=100-199"}},
+		{endpoint: "/epr/example/example-1.0.0.zip"},
+		{endpoint: "/epr/example/example-1.0.0.tar.gz"},
+	}
+
+	for _, e := range endpoints {
+		t.Run(e.endpoint, func(t *testing.T) {
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, e.endpoint, nil)
+				for name, value := range e.headers {
+					req.Header.Set(name, value)
+				}
+				return req
+			}
+
+			expected := httptest.NewRecorder()
+			expectedRouter.ServeHTTP(expected, newRequest())
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, newRequest())
+
+			assert.Equal(t, expected.Code, recorder.Code)
+			assert.Equal(t, expected.Header().Get("Content-Type"), recorder.Header().Get("Content-Type"))
+			assert.Equal(t, expected.Header().Get("Content-Range"), recorder.Header().Get("Content-Range"))
+			assert.Equal(t, expected.Header().Get("Content-Length"), recorder.Header().Get("Content-Length"))
+			assert.Equal(t, expected.Header().Get("Digest"), recorder.Header().Get("Digest"))
+			assert.Equal(t, expected.Body.String(), recorder.Body.String())
+		})
+	}
+}
+
+func TestS3IndexerWithoutChecksums(t *testing.T) {
+	storage := newTestObjectStorage("packages", map[string]string{
+		"staging/example-1.0.1.zip": "testdata/local-storage/example-1.0.1.zip",
+	})
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	client, err := newS3Client(BucketConfig{
+		Bucket:          "packages",
+		Region:          "us-east-1",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+	})
+	require.NoError(t, err)
+	indexer := packages.NewS3Indexer(client, "packages", "staging/")
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	// Packages are not downloaded to compute their checksums till they are needed.
+	assert.Empty(t, storage.completeReads())
+
+	config := Config{CacheTimeCatchAll: testCacheTime}
+	router, err := getRouter(&config, indexer, nil)
+	require.NoError(t, err)
+	serve := func(endpoint string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, endpoint, nil))
+		return recorder
+	}
+
+	search := serve("/search?package=example")
+	require.Equal(t, http.StatusOK, search.Code)
+	assert.NotContains(t, search.Body.String(), "sha256")
+	assert.Empty(t, storage.completeReads())
+
+	expected, err := ioutil.ReadFile("testdata/local-storage/example-1.0.1.zip.sha256")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		checksum := serve("/epr/example/example-1.0.1.zip.sha256")
+		require.Equal(t, http.StatusOK, checksum.Code)
+		assert.Equal(t, strings.Fields(string(expected))[0], strings.Fields(checksum.Body.String())[0])
+	}
+	assert.Equal(t, []string{"staging/example-1.0.1.zip"}, storage.completeReads(), "checksums are computed only once")
+}
+
+// testObjectStorage is a minimal S3-compatible object storage, it supports listing objects
+// of a bucket, and getting objects or ranges of them.
+type testObjectStorage struct {
+	bucket  string
+	objects map[string]string
+
+	mu       sync.Mutex
+	complete []string
+}
+
+func newTestObjectStorage(bucket string, objects map[string]string) *testObjectStorage {
+	return &testObjectStorage{
+		bucket:  bucket,
+		objects: objects,
+	}
+}
+
+type testListBucketResult struct {
+	XMLName     xml.Name            `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string              `xml:"Name"`
+	Prefix      string              `xml:"Prefix"`
+	KeyCount    int                 `xml:"KeyCount"`
+	IsTruncated bool                `xml:"IsTruncated"`
+	Contents    []testObjectSummary `xml:"Contents"`
+}
+
+type testObjectSummary struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+func (s *testObjectStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+s.bucket)
+	if path == "" || path == "/" {
+		s.listObjects(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(path, "/")
+	filePath, found := s.objects[key]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		s.mu.Lock()
+		s.complete = append(s.complete, key)
+		s.mu.Unlock()
+	}
+	http.ServeFile(w, r, filePath)
+}
+
+func (s *testObjectStorage) listObjects(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	result := testListBucketResult{
+		Name:   s.bucket,
+		Prefix: prefix,
+	}
+	for key, filePath := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Contents = append(result.Contents, testObjectSummary{
+			Key:          key,
+			LastModified: info.ModTime().UTC(),
+			Size:         info.Size(),
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *testObjectStorage) completeReads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.complete
+}
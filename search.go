@@ -7,10 +7,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
@@ -21,33 +23,174 @@ import (
 	"github.com/elastic/package-registry/util"
 )
 
-func searchHandler(indexer Indexer, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
+const (
+	// Number of packages per page when only the page is requested.
+	defaultSearchPerPage = 20
+
+	// Maximum number of packages that can be requested per page.
+	maxSearchPerPage = 1000
+
+	totalCountHeader = "X-Total-Count"
+	linkHeader       = "Link"
+)
+
+func searchHandler(indexer Indexer, cache *responseCache, cacheTime time.Duration) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		filter, err := newSearchFilterFromQuery(r.URL.Query())
 		if err != nil {
 			badRequest(w, err.Error())
 			return
 		}
-		opts := packages.GetOptions{
-			Filter: filter,
-		}
-
-		packages, err := indexer.Get(r.Context(), &opts)
+		restrictFilter(r.Context(), filter)
+		resultsOptions, err := newSearchResultsOptionsFromQuery(r.URL.Query())
 		if err != nil {
-			notFoundError(w, errors.Wrapf(err, "fetching package failed"))
+			badRequest(w, err.Error())
 			return
 		}
 
-		data, err := getPackageOutput(r.Context(), packages)
-		if err != nil {
-			notFoundError(w, err)
+		key := "search:" + filter.Key() + "," + resultsOptions.key()
+		response, ok := cache.getOrBuild(indexer, key, func() (*cachedResponse, bool) {
+			opts := packages.GetOptions{
+				Filter: filter,
+			}
+
+			packages, err := indexer.Get(r.Context(), &opts)
+			if err != nil {
+				notFoundError(w, errors.Wrapf(err, "fetching package failed"))
+				return nil, false
+			}
+
+			err = resultsOptions.sort(packages)
+			if err != nil {
+				badRequest(w, err.Error())
+				return nil, false
+			}
+
+			total := len(packages)
+			packages = resultsOptions.paginate(packages)
+
+			data, err := getPackageOutput(r.Context(), packages)
+			if err != nil {
+				notFoundError(w, err)
+				return nil, false
+			}
+			return &cachedResponse{json: newJSONResponse(data), total: total}, true
+		})
+		if !ok {
 			return
 		}
 
 		cacheHeaders(w, cacheTime)
-		jsonHeader(w)
-		fmt.Fprint(w, string(data))
+		w.Header().Set(totalCountHeader, strconv.Itoa(response.total))
+		if links := resultsOptions.links(r.URL, response.total); len(links) > 0 {
+			w.Header().Set(linkHeader, strings.Join(links, ", "))
+		}
+		response.json.serve(w, r)
+	}
+}
+
+// searchResultsOptions are the options to sort and paginate search results.
+type searchResultsOptions struct {
+	sortBy   string
+	sortDesc bool
+
+	// Page requested, starting at 1. If perPage is zero, results are not paginated.
+	page    int
+	perPage int
+}
+
+func newSearchResultsOptionsFromQuery(query url.Values) (*searchResultsOptions, error) {
+	var options searchResultsOptions
+
+	if v := query.Get("sort"); v != "" {
+		options.sortDesc = strings.HasPrefix(v, "-")
+		options.sortBy = strings.TrimPrefix(v, "-")
+		switch options.sortBy {
+		case packages.SortByName, packages.SortByTitle, packages.SortByVersion, packages.SortByRelease:
+		default:
+			return nil, fmt.Errorf("invalid 'sort' query param: '%s'", v)
+		}
+	}
+
+	var err error
+	options.page = 1
+	if v := query.Get("page"); v != "" {
+		options.page, err = strconv.Atoi(v)
+		if err != nil || options.page < 1 {
+			return nil, fmt.Errorf("invalid 'page' query param: '%s'", v)
+		}
+		options.perPage = defaultSearchPerPage
+	}
+
+	if v := query.Get("per_page"); v != "" {
+		options.perPage, err = strconv.Atoi(v)
+		if err != nil || options.perPage < 1 || options.perPage > maxSearchPerPage {
+			return nil, fmt.Errorf("invalid 'per_page' query param: '%s', it must be between 1 and %d", v, maxSearchPerPage)
+		}
+	}
+
+	return &options, nil
+}
+
+// key returns a string that identifies the options, equivalent options have the same key.
+func (o *searchResultsOptions) key() string {
+	return fmt.Sprintf("sort=%q,desc=%t,page=%d,per_page=%d", o.sortBy, o.sortDesc, o.page, o.perPage)
+}
+
+// sort sorts the packages by the requested field. By default, they are sorted by relevance if
+// there is a full-text query, and by title and version otherwise.
+func (o *searchResultsOptions) sort(packageList packages.Packages) error {
+	if o.sortBy == "" {
+		sort.Sort(packageList)
+		return nil
 	}
+	return packageList.SortBy(o.sortBy, o.sortDesc)
+}
+
+// paginate returns the packages in the requested page.
+func (o *searchResultsOptions) paginate(packageList packages.Packages) packages.Packages {
+	if o.perPage == 0 {
+		return packageList
+	}
+	start := (o.page - 1) * o.perPage
+	if start >= len(packageList) {
+		return nil
+	}
+	end := start + o.perPage
+	if end > len(packageList) {
+		end = len(packageList)
+	}
+	return packageList[start:end]
+}
+
+// links returns the links to other pages of the results, to be used in the Link header.
+func (o *searchResultsOptions) links(u *url.URL, total int) []string {
+	if o.perPage == 0 {
+		return nil
+	}
+
+	lastPage := (total + o.perPage - 1) / o.perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	link := func(page int, rel string) string {
+		query := u.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(o.perPage))
+		pageURL := url.URL{Path: u.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, pageURL.String(), rel)
+	}
+
+	links := []string{link(1, "first")}
+	if o.page > 1 && o.page <= lastPage {
+		links = append(links, link(o.page-1, "prev"))
+	}
+	if o.page < lastPage {
+		links = append(links, link(o.page+1, "next"))
+	}
+	links = append(links, link(lastPage, "last"))
+	return links
 }
 
 func newSearchFilterFromQuery(query url.Values) (*packages.Filter, error) {
@@ -73,6 +216,33 @@ func newSearchFilterFromQuery(query url.Values) (*packages.Filter, error) {
 		filter.PackageName = v
 	}
 
+	if v := query.Get("type"); v != "" {
+		filter.PackageType = v
+	}
+
+	if v := query.Get("release"); v != "" {
+		if !packages.IsValidRelease(v) {
+			return nil, fmt.Errorf("invalid 'release' query param: '%s'", v)
+		}
+		filter.Release = v
+	}
+
+	if v := query.Get("owner"); v != "" {
+		filter.Owner = v
+	}
+
+	if v := query.Get("data_stream.type"); v != "" {
+		filter.DataStreamType = v
+	}
+
+	if v := query.Get("input"); v != "" {
+		filter.Input = v
+	}
+
+	if v := strings.TrimSpace(query.Get("q")); v != "" {
+		filter.Query = v
+	}
+
 	if v := query.Get("all"); v != "" {
 		// Default is false, also on error
 		filter.AllVersions, err = strconv.ParseBool(v)
@@ -100,16 +270,15 @@ func newSearchFilterFromQuery(query url.Values) (*packages.Filter, error) {
 	return &filter, nil
 }
 
+// getPackageOutput returns the search output for the packages, in the same order they are given.
 func getPackageOutput(ctx context.Context, packageList packages.Packages) ([]byte, error) {
 	span, ctx := apm.StartSpan(ctx, "GetPackageOutput", "app")
 	defer span.End()
 
-	// Packages need to be sorted to be always outputted in the same order
-	sort.Sort(packageList)
-
 	var output []packages.BasePackage
 	for _, p := range packageList {
 		data := p.BasePackage
+		data.SHA256 = packageDigest(p)
 		output = append(output, data)
 	}
 
@@ -120,3 +289,14 @@ func getPackageOutput(ctx context.Context, packageList packages.Packages) ([]byt
 
 	return util.MarshalJSONPretty(output)
 }
+
+// packageDigest returns the checksum of the package to include in its metadata. Checksums of
+// packages archived when served are computed the first time they are needed. It returns an
+// empty string if the checksum is unknown or cannot be obtained.
+func packageDigest(p *packages.Package) string {
+	digest, err := p.MetadataDigest()
+	if err != nil {
+		log.Printf("getting checksum of package failed (path: %s): %v", p.BasePath, err)
+	}
+	return digest
+}
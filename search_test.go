@@ -0,0 +1,81 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestSearchPagination(t *testing.T) {
+	indexer := packages.NewFileSystemIndexer("./testdata/package")
+	err := indexer.Init(context.Background())
+	require.NoError(t, err)
+
+	handler := searchHandler(indexer, nil, testCacheTime)
+
+	cases := []struct {
+		endpoint      string
+		expectedTotal string
+		expectedLink  string
+	}{
+		{
+			endpoint:      "/search",
+			expectedTotal: "18",
+		},
+		{
+			endpoint:      "/search?page=1",
+			expectedTotal: "18",
+			expectedLink: `</search?page=1&per_page=20>; rel="first", ` +
+				`</search?page=1&per_page=20>; rel="last"`,
+		},
+		{
+			endpoint:      "/search?sort=name&per_page=5",
+			expectedTotal: "18",
+			expectedLink: `</search?page=1&per_page=5&sort=name>; rel="first", ` +
+				`</search?page=2&per_page=5&sort=name>; rel="next", ` +
+				`</search?page=4&per_page=5&sort=name>; rel="last"`,
+		},
+		{
+			endpoint:      "/search?sort=name&page=2&per_page=5",
+			expectedTotal: "18",
+			expectedLink: `</search?page=1&per_page=5&sort=name>; rel="first", ` +
+				`</search?page=1&per_page=5&sort=name>; rel="prev", ` +
+				`</search?page=3&per_page=5&sort=name>; rel="next", ` +
+				`</search?page=4&per_page=5&sort=name>; rel="last"`,
+		},
+		{
+			endpoint:      "/search?sort=name&page=4&per_page=5",
+			expectedTotal: "18",
+			expectedLink: `</search?page=1&per_page=5&sort=name>; rel="first", ` +
+				`</search?page=3&per_page=5&sort=name>; rel="prev", ` +
+				`</search?page=4&per_page=5&sort=name>; rel="last"`,
+		},
+		{
+			endpoint:      "/search?package=missing&page=1&per_page=5",
+			expectedTotal: "0",
+			expectedLink: `</search?package=missing&page=1&per_page=5>; rel="first", ` +
+				`</search?package=missing&page=1&per_page=5>; rel="last"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.endpoint, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodGet, c.endpoint, nil))
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, c.expectedTotal, recorder.Header().Get(totalCountHeader))
+			assert.Equal(t, c.expectedLink, recorder.Header().Get(linkHeader))
+		})
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"log"
 	"net/http"
 	"time"
@@ -14,9 +15,14 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
 )
 
-const signaturesRouterPath = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.zip.sig"
+const (
+	signaturesRouterPath    = "/epr/{packageName}/{packageName:[a-z0-9_]+}-{packageVersion}.zip.sig"
+	publicKeyRouterPath     = "/signatures/public-key.asc"
+	publicKeyInfoRouterPath = "/signatures/public-key.json"
+)
 
 var errSignatureFileNotFound = errors.New("signature file not found")
 
@@ -42,6 +48,7 @@ func signaturesHandler(indexer Indexer, cacheTime time.Duration) func(w http.Res
 		}
 
 		opts := packages.NameVersionFilter(packageName, packageVersion)
+		restrictFilter(r.Context(), opts.Filter)
 		packageList, err := indexer.Get(r.Context(), &opts)
 		if err != nil {
 			log.Printf("getting package path failed: %v", err)
@@ -57,3 +64,40 @@ func signaturesHandler(indexer Indexer, cacheTime time.Duration) func(w http.Res
 		packages.ServeSignature(w, r, packageList[0])
 	}
 }
+
+// publicKeyInfo is the descriptor of the public keys used to verify the signatures of packages.
+type publicKeyInfo struct {
+	PublicKey string                   `json:"public_key"`
+	Keys      []packages.PublicKeyInfo `json:"keys"`
+}
+
+// publicKeyHandler serves the armored public keys used to verify the signatures of packages.
+func publicKeyHandler(verifier *packages.SignatureVerifier, cacheTime time.Duration) (func(w http.ResponseWriter, r *http.Request), error) {
+	var buf bytes.Buffer
+	err := verifier.WriteArmoredPublicKeys(&buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding public keys failed")
+	}
+	body := buf.Bytes()
+	return func(w http.ResponseWriter, r *http.Request) {
+		cacheHeaders(w, cacheTime)
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		http.ServeContent(w, r, "public-key.asc", time.Time{}, bytes.NewReader(body))
+	}, nil
+}
+
+// publicKeyInfoHandler serves the descriptor of the public keys used to verify the signatures of packages.
+func publicKeyInfoHandler(verifier *packages.SignatureVerifier, cacheTime time.Duration) (func(w http.ResponseWriter, r *http.Request), error) {
+	body, err := util.MarshalJSONPretty(publicKeyInfo{
+		PublicKey: publicKeyRouterPath,
+		Keys:      verifier.PublicKeys(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := newJSONResponse(body)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cacheHeaders(w, cacheTime)
+		response.serve(w, r)
+	}, nil
+}
@@ -33,6 +33,7 @@ func staticHandler(indexer Indexer, cacheTime time.Duration) http.HandlerFunc {
 		}
 
 		opts := packages.NameVersionFilter(params.packageName, params.packageVersion)
+		restrictFilter(r.Context(), opts.Filter)
 		packageList, err := indexer.Get(r.Context(), &opts)
 		if err != nil {
 			log.Printf("getting package path failed: %v", err)
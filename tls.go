@@ -0,0 +1,268 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Modes of verification of client certificates.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequired = "required"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig is the configuration of TLS for the HTTP server.
+type TLSConfig struct {
+	// Paths to the certificate and its key, in PEM format. They are read again when they
+	// change, so they can be rotated without restarting the registry.
+	Certificate string `config:"certificate"`
+	Key         string `config:"key"`
+
+	// Path to a bundle of CA certificates, in PEM format, used to verify client certificates.
+	ClientCA string `config:"client_ca"`
+
+	// Verification of client certificates, it can be `none`, `optional` or `required`. If it
+	// is not set, client certificates are required when a client CA is configured.
+	ClientAuth string `config:"client_auth"`
+
+	// Minimum TLS version accepted, as `1.2` or `1.3`.
+	MinVersion string `config:"min_version"`
+
+	// Names of the cipher suites that can be used with TLS versions up to 1.2, as
+	// `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`. Cipher suites of TLS 1.3 are not configurable.
+	CipherSuites []string `config:"cipher_suites"`
+}
+
+// enabled returns true if TLS is configured.
+func (c TLSConfig) enabled() bool {
+	return c.Certificate != "" || c.Key != ""
+}
+
+// clientAuthMode returns the mode of verification of client certificates.
+func (c TLSConfig) clientAuthMode() string {
+	switch {
+	case c.ClientAuth != "":
+		return c.ClientAuth
+	case c.ClientCA != "":
+		return clientAuthRequired
+	default:
+		return clientAuthNone
+	}
+}
+
+// newServerTLSConfig builds the TLS configuration of the HTTP server, it returns nil if TLS
+// is not enabled.
+func newServerTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if !config.enabled() {
+		if config.ClientCA != "" || config.ClientAuth != "" || config.MinVersion != "" || len(config.CipherSuites) > 0 {
+			return nil, errors.New("TLS options require tls.certificate and tls.key")
+		}
+		return nil, nil
+	}
+	if config.Certificate == "" || config.Key == "" {
+		return nil, errors.New("both tls.certificate and tls.key are required")
+	}
+
+	certificate, err := newCertificateReloader(config.Certificate, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certificate.GetCertificate,
+	}
+
+	if config.MinVersion != "" {
+		version, found := tlsVersions[config.MinVersion]
+		if !found {
+			return nil, errors.Errorf("unknown TLS version %q, expected one of %s", config.MinVersion, strings.Join(knownTLSVersions(), ", "))
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range config.CipherSuites {
+		id, found := cipherSuiteID(name)
+		if !found {
+			return nil, errors.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	clientAuth := config.clientAuthMode()
+	switch clientAuth {
+	case clientAuthNone:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case clientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequired:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.Errorf("unknown client authentication mode %q, expected %q, %q or %q", clientAuth, clientAuthNone, clientAuthOptional, clientAuthRequired)
+	}
+	if clientAuth != clientAuthNone {
+		if config.ClientCA == "" {
+			return nil, errors.Errorf("client authentication mode %q requires tls.client_ca", clientAuth)
+		}
+		tlsConfig.ClientCAs, err = readCertPool(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func knownTLSVersions() []string {
+	var versions []string
+	for version := range tlsVersions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// cipherSuiteID returns the ID of a secure cipher suite by its name.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading client CA failed (path: %s)", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in client CA (path: %s)", path)
+	}
+	return pool, nil
+}
+
+// certificateCheckInterval is the minimum time between checks for changes in the files of
+// the certificate.
+var certificateCheckInterval = 5 * time.Second
+
+// certificateReloader serves a certificate read from files, reading it again when the files
+// change. If the new files cannot be loaded, the previous certificate is kept. Files are checked
+// at most once every certificateCheckInterval, and handshakes don't wait for other checks.
+type certificateReloader struct {
+	// nextCheck is the time, in Unix nanoseconds, after which files are checked again. It is
+	// the first field so it is aligned for atomic operations in 32-bit platforms.
+	nextCheck int64
+
+	certFile string
+	keyFile  string
+
+	// certificate contains the current *tls.Certificate.
+	certificate atomic.Value
+
+	// mu protects the state of the files.
+	mu        sync.Mutex
+	certState certificateFileState
+	keyState  certificateFileState
+}
+
+// certificateFileState is the state of a certificate file, used to know when it changes.
+type certificateFileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func statCertificateFile(path string) (certificateFileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return certificateFileState{}, err
+	}
+	return certificateFileState{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile:  certFile,
+		keyFile:   keyFile,
+		nextCheck: time.Now().Add(certificateCheckInterval).UnixNano(),
+	}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it if its files have changed.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now().UnixNano()
+	nextCheck := atomic.LoadInt64(&r.nextCheck)
+	if now >= nextCheck && atomic.CompareAndSwapInt64(&r.nextCheck, nextCheck, now+int64(certificateCheckInterval)) {
+		r.check()
+	}
+	return r.certificate.Load().(*tls.Certificate), nil
+}
+
+// check reloads the certificate if its files have changed.
+func (r *certificateReloader) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certState, certErr := statCertificateFile(r.certFile)
+	keyState, keyErr := statCertificateFile(r.keyFile)
+	if certErr != nil || keyErr != nil || (certState == r.certState && keyState == r.keyState) {
+		return
+	}
+	err := r.reload()
+	if err != nil {
+		log.Printf("warning: reloading TLS certificate failed, keeping previous certificate: %v", err)
+		return
+	}
+	log.Printf("TLS certificate reloaded (path: %s)", r.certFile)
+}
+
+// reload loads the certificate from its files, it must be called with the mutex held, or
+// before the reloader is used. The state of the files is read before reading
+// them, so changes made while reading are detected in the next check.
+func (r *certificateReloader) reload() error {
+	certState, err := statCertificateFile(r.certFile)
+	if err != nil {
+		return errors.Wrap(err, "reading TLS certificate failed")
+	}
+	keyState, err := statCertificateFile(r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "reading TLS key failed")
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// Files are recorded as seen, so loading them is only retried when they change again,
+		// as when the other file of the pair is updated.
+		r.certState, r.keyState = certState, keyState
+		return errors.Wrapf(err, "loading TLS certificate failed (certificate: %s, key: %s)", r.certFile, r.keyFile)
+	}
+	r.certificate.Store(&certificate)
+	r.certState, r.keyState = certState, keyState
+	return nil
+}
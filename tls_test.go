@@ -0,0 +1,262 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "localhost", ca)
+	client := newTestCertificate(t, "client", ca)
+	unknownClient := newTestCertificate(t, "unknown", nil)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	writeTestCertificate(t, ca, caPath, "")
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeTestCertificate(t, server, certPath, keyPath)
+
+	cases := []struct {
+		title      string
+		clientAuth string
+		client     *testCertificate
+		success    bool
+	}{
+		{"required without client certificate", "", nil, false},
+		{"required with client certificate", "", client, true},
+		{"required with unknown client certificate", clientAuthRequired, unknownClient, false},
+		{"optional without client certificate", clientAuthOptional, nil, true},
+		{"optional with client certificate", clientAuthOptional, client, true},
+		{"optional with unknown client certificate", clientAuthOptional, unknownClient, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			tlsConfig, err := newServerTLSConfig(TLSConfig{
+				Certificate: certPath,
+				Key:         keyPath,
+				ClientCA:    caPath,
+				ClientAuth:  c.clientAuth,
+			})
+			require.NoError(t, err)
+
+			_, err = getTestTLSServer(t, tlsConfig, ca, c.client)
+			if c.success {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	defer func(interval time.Duration) { certificateCheckInterval = interval }(certificateCheckInterval)
+	certificateCheckInterval = 0
+
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeTestCertificate(t, newTestCertificate(t, "localhost", ca), certPath, keyPath)
+
+	tlsConfig, err := newServerTLSConfig(TLSConfig{
+		Certificate: certPath,
+		Key:         keyPath,
+		MinVersion:  "1.2",
+	})
+	require.NoError(t, err)
+
+	first, err := getTestTLSServer(t, tlsConfig, ca, nil)
+	require.NoError(t, err)
+
+	// Use a different modification time, so the change is detected even if the files
+	// have the same size.
+	renewed := newTestCertificate(t, "localhost", ca)
+	writeTestCertificate(t, renewed, certPath, keyPath)
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+
+	second, err := getTestTLSServer(t, tlsConfig, ca, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.SerialNumber, second.SerialNumber)
+	assert.Equal(t, renewed.certificate.SerialNumber, second.SerialNumber)
+
+	// Invalid files are ignored, and the previous certificate is kept.
+	require.NoError(t, ioutil.WriteFile(certPath, []byte("invalid"), 0644))
+	third, err := getTestTLSServer(t, tlsConfig, ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.SerialNumber, third.SerialNumber)
+}
+
+func TestTLSCertificateCheckInterval(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeTestCertificate(t, newTestCertificate(t, "localhost", ca), certPath, keyPath)
+
+	reloader, err := newCertificateReloader(certPath, keyPath)
+	require.NoError(t, err)
+	first, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+
+	writeTestCertificate(t, newTestCertificate(t, "localhost", ca), certPath, keyPath)
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+
+	// Files are not checked again till the interval passes.
+	current, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, current)
+
+	atomic.StoreInt64(&reloader.nextCheck, 0)
+	current, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotSame(t, first, current)
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeTestCertificate(t, newTestCertificate(t, "localhost", nil), certPath, keyPath)
+
+	cases := []struct {
+		title  string
+		config TLSConfig
+	}{
+		{"missing key", TLSConfig{Certificate: certPath}},
+		{"options without certificate", TLSConfig{MinVersion: "1.2"}},
+		{"unknown version", TLSConfig{Certificate: certPath, Key: keyPath, MinVersion: "2.0"}},
+		{"unknown cipher suite", TLSConfig{Certificate: certPath, Key: keyPath, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}},
+		{"unknown client auth", TLSConfig{Certificate: certPath, Key: keyPath, ClientAuth: "always"}},
+		{"client auth without CA", TLSConfig{Certificate: certPath, Key: keyPath, ClientAuth: clientAuthRequired}},
+		{"missing CA", TLSConfig{Certificate: certPath, Key: keyPath, ClientCA: filepath.Join(dir, "missing.pem")}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			_, err := newServerTLSConfig(c.config)
+			assert.Error(t, err)
+		})
+	}
+
+	tlsConfig, err := newServerTLSConfig(TLSConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	der         []byte
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate signed by the given CA. If no CA is given, the
+// certificate is a self-signed CA.
+func newTestCertificate(t *testing.T, name string, ca *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.certificate, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCertificate{certificate: certificate, der: der, key: key}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeTestCertificate(t *testing.T, c *testCertificate, certPath, keyPath string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	require.NoError(t, ioutil.WriteFile(certPath, certPEM, 0644))
+	if keyPath == "" {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, ioutil.WriteFile(keyPath, keyPEM, 0600))
+}
+
+// getTestTLSServer starts a server with the given TLS configuration and makes a request to it,
+// it returns the certificate presented by the server.
+func getTestTLSServer(t *testing.T, tlsConfig *tls.Config, ca, client *testCertificate) (*x509.Certificate, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	clientTLSConfig := &tls.Config{RootCAs: roots}
+	if client != nil {
+		// The certificate is always sent, even if it is not signed by the CAs accepted by the server.
+		certificate := client.tlsCertificate()
+		clientTLSConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &certificate, nil
+		}
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig}}
+	defer httpClient.CloseIdleConnections()
+
+	resp, err := httpClient.Get("https://" + listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.TLS.PeerCertificates[0], nil
+}
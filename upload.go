@@ -0,0 +1,112 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
+)
+
+const uploadRouterPath = "/packages"
+
+// uploadErrors is the body of the responses of failed uploads.
+type uploadErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// uploadHandler publishes zipped packages sent in the body of the request. Packages are
+// validated before being published, and versions already available cannot be replaced.
+// If the request has a package name and version, as when uploaded to the path of the
+// artifact, they must match the ones of the package.
+func uploadHandler(indexer Indexer, publisher Publisher, maxSize int64) http.HandlerFunc {
+	// mu serializes uploads, so the same version cannot be published twice.
+	var mu sync.Mutex
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := &io.LimitedReader{R: r.Body, N: maxSize + 1}
+		staged, err := publisher.StagePackage(body)
+		if body.N <= 0 {
+			if err == nil {
+				staged.Discard()
+			}
+			uploadError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("package is larger than %d bytes", maxSize))
+			return
+		}
+		var invalidErr *packages.InvalidPackageError
+		if errors.As(err, &invalidErr) {
+			uploadError(w, http.StatusBadRequest, invalidErr.Problems...)
+			return
+		}
+		if err != nil {
+			log.Printf("staging uploaded package failed: %v", err)
+			uploadError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		vars := mux.Vars(r)
+		if name, found := vars["packageName"]; found && (name != staged.Name || vars["packageVersion"] != staged.Version) {
+			staged.Discard()
+			uploadError(w, http.StatusBadRequest, fmt.Sprintf("package %s-%s doesn't match the upload path", staged.Name, staged.Version))
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		opts := packages.NameVersionFilter(staged.Name, staged.Version)
+		existing, err := indexer.Get(r.Context(), &opts)
+		if err != nil {
+			staged.Discard()
+			log.Printf("looking for existing package failed: %v", err)
+			uploadError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if len(existing) > 0 {
+			staged.Discard()
+			uploadError(w, http.StatusConflict, fmt.Sprintf("package %s-%s already exists", staged.Name, staged.Version))
+			return
+		}
+
+		err = staged.Publish(r.Context())
+		if errors.Is(err, packages.ErrPackageExists) {
+			uploadError(w, http.StatusConflict, fmt.Sprintf("package %s-%s already exists", staged.Name, staged.Version))
+			return
+		}
+		if err != nil {
+			log.Printf("publishing uploaded package failed: %v", err)
+			uploadError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		log.Printf("Package %s-%s uploaded (path: %s)", staged.Name, staged.Version, staged.BasePath)
+
+		noCacheHeaders(w)
+		jsonHeader(w)
+		w.Header().Set("Location", staged.GetDownloadPath())
+		w.WriteHeader(http.StatusCreated)
+		err = util.WriteJSONPretty(w, staged.BasePackage)
+		if err != nil {
+			log.Printf("marshaling uploaded package failed: %v", err)
+		}
+	}
+}
+
+func uploadError(w http.ResponseWriter, status int, problems ...string) {
+	noCacheHeaders(w)
+	jsonHeader(w)
+	w.WriteHeader(status)
+	err := util.WriteJSONPretty(w, uploadErrors{Errors: problems})
+	if err != nil {
+		log.Printf("marshaling upload errors failed: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+	"github.com/elastic/package-registry/util"
+)
+
+func TestUpload(t *testing.T) {
+	const token = "secret"
+
+	tmpDir := t.TempDir()
+	packagesPath := filepath.Join(tmpDir, "packages")
+	require.NoError(t, util.CopyDir("testdata/package/example/1.0.0", filepath.Join(packagesPath, "example", "1.0.0")))
+
+	config := defaultConfig
+	config.PackagePaths = []string{packagesPath}
+	config.AdminToken = token
+	config.UploadPath = filepath.Join(tmpDir, "uploads")
+
+	indexer, err := newIndexer(&config)
+	require.NoError(t, err)
+	err = indexer.Init(context.Background())
+	require.NoError(t, err)
+	router, err := getRouter(&config, indexer, nil)
+	require.NoError(t, err)
+
+	validPackage, err := ioutil.ReadFile("testdata/local-storage/example-1.0.1.zip")
+	require.NoError(t, err)
+
+	upload := func(t *testing.T, method, endpoint string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, uploadRouterPath, bytes.NewReader(validPackage))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("invalid package", func(t *testing.T) {
+		recorder := upload(t, http.MethodPost, uploadRouterPath, invalidPackageZip(t))
+		require.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+
+		var result uploadErrors
+		err := json.Unmarshal(recorder.Body.Bytes(), &result)
+		require.NoError(t, err)
+		assert.Len(t, result.Errors, 3)
+	})
+
+	t.Run("name out of upload directory", func(t *testing.T) {
+		packages.ValidationDisabled = true
+		defer func() { packages.ValidationDisabled = false }()
+
+		files := map[string]string{
+			"manifest.yml":   "format_version: 1.0.0\nname: ../escaped\nversion: 1.0.0\n",
+			"docs/README.md": "# Escaped\n",
+		}
+		recorder := upload(t, http.MethodPost, uploadRouterPath, packageZip(t, "escaped-1.0.0", files))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+		assert.NoFileExists(t, filepath.Join(tmpDir, "escaped-1.0.0.zip"))
+	})
+
+	t.Run("path not matching package", func(t *testing.T) {
+		recorder := upload(t, http.MethodPut, "/epr/example/example-2.0.0.zip", validPackage)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		assertPackageStatus(t, router, "/package/example/1.0.1/", http.StatusNotFound)
+
+		recorder := upload(t, http.MethodPut, "/epr/example/example-1.0.1.zip", validPackage)
+		require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "/epr/example/example-1.0.1.zip", recorder.Header().Get("Location"))
+
+		assertPackageStatus(t, router, "/package/example/1.0.1/", http.StatusOK)
+		assertPackageStatus(t, router, "/epr/example/example-1.0.1.zip", http.StatusOK)
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/search?package=example", nil))
+		var result []packages.BasePackage
+		err := json.Unmarshal(recorder.Body.Bytes(), &result)
+		require.NoError(t, err)
+		require.Len(t, result, 1)
+		assert.Equal(t, "1.0.1", result[0].Version)
+	})
+
+	t.Run("duplicated", func(t *testing.T) {
+		recorder := upload(t, http.MethodPost, uploadRouterPath, validPackage)
+		assert.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		config := config
+		config.UploadMaxSize = 10
+		router, err := getRouter(&config, indexer, nil)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, uploadRouterPath, bytes.NewReader(validPackage))
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code, recorder.Body.String())
+	})
+}
+
+// invalidPackageZip builds a zipped package without title and description, and with an unknown category.
+func invalidPackageZip(t *testing.T) []byte {
+	return packageZip(t, "invalid-1.0.0", map[string]string{
+		"manifest.yml": "format_version: 1.0.0\nname: invalid\nversion: 1.0.0\ncategories: [unknown]\n",
+	})
+}
+
+// packageZip builds a zipped package with the given files in the given root directory.
+func packageZip(t *testing.T, root string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(root + "/" + name)
+		require.NoError(t, err)
+		_, err = io.WriteString(f, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
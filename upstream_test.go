@@ -0,0 +1,91 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/package-registry/packages"
+)
+
+func TestUpstreamIndexer(t *testing.T) {
+	config := Config{
+		CacheTimeIndex:      testCacheTime,
+		CacheTimeSearch:     testCacheTime,
+		CacheTimeCategories: testCacheTime,
+		CacheTimeCatchAll:   testCacheTime,
+	}
+
+	upstreamIndexer := NewCombinedIndexer(
+		packages.NewFileSystemIndexer("./testdata/package"),
+		packages.NewZipFileSystemIndexer("./testdata/local-storage"),
+	)
+	err := upstreamIndexer.Init(context.Background())
+	require.NoError(t, err)
+	upstreamRouter, err := getRouter(&config, upstreamIndexer, nil)
+	require.NoError(t, err)
+	upstream := httptest.NewServer(upstreamRouter)
+	defer upstream.Close()
+
+	cases := []struct {
+		title     string
+		cachePath string
+	}{
+		{title: "proxy"},
+		{title: "cache", cachePath: t.TempDir()},
+	}
+
+	endpoints := []string{
+		"/search",
+		"/search?kibana.version=8.0.0",
+		"/search?all=true&experimental=true",
+		"/search?category=web&kibana.version=7.2.1",
+		"/categories?include_policy_templates=true",
+		"/categories?include_policy_templates=true&kibana.version=8.0.0",
+		"/package/example/1.0.0/",
+		"/package/example/1.0.1/",
+		"/package/example/1.0.1/docs/README.md",
+		"/package/example/1.0.0/img/kibana-envoyproxy.jpg",
+		"/epr/example/example-1.0.1.zip",
+		"/epr/example/example-1.0.1.zip.sig",
+		"/package/example/999.0.0/",
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			indexer := packages.NewUpstreamIndexer(upstream.URL, c.cachePath)
+			err := indexer.Init(context.Background())
+			require.NoError(t, err)
+
+			router, err := getRouter(&config, indexer, nil)
+			require.NoError(t, err)
+
+			for _, endpoint := range endpoints {
+				t.Run(endpoint, func(t *testing.T) {
+					expected := httptest.NewRecorder()
+					upstreamRouter.ServeHTTP(expected, httptest.NewRequest(http.MethodGet, endpoint, nil))
+
+					recorder := httptest.NewRecorder()
+					router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, endpoint, nil))
+
+					assert.Equal(t, expected.Code, recorder.Code)
+					assert.Equal(t, expected.Body.String(), recorder.Body.String())
+				})
+			}
+
+			if c.cachePath != "" {
+				assert.FileExists(t, filepath.Join(c.cachePath, "epr", "example", "example-1.0.1.zip"))
+				assert.FileExists(t, filepath.Join(c.cachePath, "epr", "example", "example-1.0.1.zip.sig"))
+			}
+		})
+	}
+}